@@ -2,24 +2,88 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"github.com/whzghb/kube-apiserver-proxy/pkg/api"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authenticator"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/config"
 	"github.com/whzghb/kube-apiserver-proxy/pkg/middlerware"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/user"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"net/http"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
 )
 
 var scheme = runtime.NewScheme()
 
+var (
+	configFile = flag.String("config", "", "Path of the YAML config: field indexes per kind, kinds allowed to be cached. Without it no kind is cached.")
+
+	userStore  = flag.String("user-store", "file", "Backend of the user store, one of: file, secret.")
+	userFile   = flag.String("user-file", "users.yaml", "Path of the users file when --user-store=file.")
+	userSecret = flag.String("user-secret", "default/kube-apiserver-proxy-users", "Namespace/name of the users Secret when --user-store=secret.")
+
+	oidcIssuerURL    = flag.String("oidc-issuer-url", "", "Issuer of the OpenID provider users may log in with at /user/oidc/login, disabled if empty.")
+	oidcClientID     = flag.String("oidc-client-id", "", "Client id of the proxy at the OpenID provider.")
+	oidcClientSecret = flag.String("oidc-client-secret", "", "Client secret of the proxy at the OpenID provider, empty for public clients.")
+	oidcRedirectURL  = flag.String("oidc-redirect-url", "http://127.0.0.1:8001/user/oidc/callback", "URL of /user/oidc/callback as registered at the OpenID provider.")
+	oidcScopes       = flag.String("oidc-scopes", "openid,email,profile", "Comma separated scopes requested from the OpenID provider.")
+	oidcUserClaim    = flag.String("oidc-username-claim", "email", "ID token claim naming the proxy user.")
+	oidcGroupsClaim  = flag.String("oidc-groups-claim", "groups", "ID token claim listing the groups of the user.")
+	oidcUserPrefix   = flag.String("oidc-username-prefix", "oidc-", "Prefix of the names of users logged in with the OpenID provider.")
+	oidcGroupsPrefix = flag.String("oidc-groups-prefix", "oidc:", "Prefix of the groups of users logged in with the OpenID provider.")
+	oidcNamespace    = flag.String("oidc-namespace", "default", "Home namespace of users logged in with the OpenID provider.")
+
+	clientCAFile  = flag.String("client-ca-file", "", "CA bundle client certificates are verified against, the common name is the user and the organizations its groups; requires --tls-cert-file.")
+	tokenAuthFile = flag.String("token-auth-file", "", "CSV file of static bearer tokens, one token,user,uid,\"group1,group2\" per line.")
+	tlsCertFile   = flag.String("tls-cert-file", "", "Certificate the proxy serves HTTPS with, plain HTTP if empty.")
+	tlsKeyFile    = flag.String("tls-private-key-file", "", "Private key of --tls-cert-file.")
+
+	localTokenVerification = flag.Bool("local-token-verification", true, "Verify ServiceAccount tokens against the keys of the apiserver's issuer discovery instead of a TokenReview each, bound tokens are still reviewed.")
+	tokenAudiences         = flag.String("token-audiences", "", "Comma separated audiences ServiceAccount tokens must have one of when verified locally, the issuer if empty.")
+
+	authorizationMode = flag.String("authorization-mode", "rbac", "How requests are authorized, one of: rbac (evaluate RBAC objects from the cache), sar (SubjectAccessReview against the apiserver).")
+	sarCacheTTL       = flag.Duration("sar-cache-ttl", 10*time.Second, "How long SubjectAccessReview decisions are cached when --authorization-mode=sar.")
+
+	watchQueueSize    = flag.Int("watch-queue-size", 1000, "Maximum number of events queued for a single watcher.")
+	watchWindowSize   = flag.Int("watch-window-size", 100, "Number of recent events kept per watched kind, watches resuming from an older resourceVersion get 410 Gone.")
+	watchCoalesce     = flag.Duration("watch-coalesce-window", 0, "How long changes of a server-sent events list watch are collected and coalesced before being sent.")
+	watchBackpressure = flag.String("watch-backpressure", "coalesce", "What to do with a watcher whose queue is full, one of: drop (drop new events), coalesce (merge events of the same object, disconnect if still full), disconnect.")
+
+	informerIdleTTL = flag.Duration("informer-idle-ttl", 10*time.Minute, "Stop the informers started for reads and watches once neither watched nor read for that long, 0 keeps them forever.")
+
+	tokenCache     = flag.String("token-cache", "memory", "Where authenticated tokens are cached, one of: memory, redis (shared by the replicas, logouts revoke tokens on all of them).")
+	tokenCacheTTL  = flag.Duration("token-cache-ttl", auth.DefaultTokenCacheTTL, "How long an authenticated token is trusted before being authenticated again, never past its exp claim.")
+	tokenCacheSize = flag.Int("token-cache-size", auth.DefaultTokenCacheSize, "Maximum number of tokens cached by a replica, the least recently used are evicted first.")
+	redisAddr      = flag.String("redis-addr", "localhost:6379", "Address of Redis when --token-cache=redis.")
+	redisPassword  = flag.String("redis-password", "", "Password of Redis when --token-cache=redis.")
+	redisDB        = flag.Int("redis-db", 0, "Database of Redis when --token-cache=redis.")
+
+	reverseProxy = flag.Bool("reverse-proxy", false, "Forward authorized requests without a dedicated route (subresources, discovery, aggregated APIs) to the apiserver.")
+	impersonate  = flag.Bool("impersonate", false, "Send CRUD requests and watches to the apiserver impersonating the authenticated user, so the apiserver enforces its own RBAC and audits the real user.")
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 }
 
 func main() {
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	succeedOrDie(err)
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		//NewClient: func(config *rest.Config, options client.Options) (client.Client, error) {
 		//	return client.New(config, client.Options{
@@ -33,38 +97,54 @@ func main() {
 	succeedOrDie(err)
 
 	for _, obj := range []client.Object{&rbacv1.RoleBinding{}, &rbacv1.ClusterRoleBinding{}} {
-		succeedOrDie(mgr.GetFieldIndexer().IndexField(context.Background(), obj, ".subjects[*].name", func(rawObj client.Object) []string {
-			names := make([]string, 0, 10)
-			switch rawObj.(type) {
-			case *rbacv1.RoleBinding:
-				rb := rawObj.(*rbacv1.RoleBinding)
-				for _, sub := range rb.Subjects {
-					names = append(names, sub.Name)
-				}
-			case *rbacv1.ClusterRoleBinding:
-				rb := rawObj.(*rbacv1.ClusterRoleBinding)
-				for _, sub := range rb.Subjects {
-					names = append(names, sub.Name)
-				}
-			}
-			return names
-		}))
+		succeedOrDie(mgr.GetFieldIndexer().IndexField(context.Background(), obj, authorizer.SubjectIndex, authorizer.SubjectIndexFunc))
 	}
+	fieldIndexes := cfg.FieldIndexesByKind()
+	succeedOrDie(api.IndexFields(context.Background(), mgr.GetFieldIndexer(), fieldIndexes))
 
 	go func() {
 		succeedOrDie(mgr.Start(context.Background()))
 	}()
 
+	auth.Cache, err = newTokenCache()
+	succeedOrDie(err)
+
+	users, err := newUserStore(mgr)
+	succeedOrDie(err)
+
+	authz, err := newAuthorizer(mgr)
+	succeedOrDie(err)
+
 	r := gin.Default()
-	r.Use(middlerware.Auth(mgr))
+	oidc := newOIDC()
+	authn, err := newAuthenticator(mgr, oidc)
+	succeedOrDie(err)
+
+	r.Use(middlerware.Auth(authn, users, authz))
 	r.Use(middlerware.HeadersMiddleware())
 
-	a := api.NewApi(mgr)
+	backpressure, err := api.ParseBackpressurePolicy(*watchBackpressure)
+	succeedOrDie(err)
+	a, err := api.NewApi(mgr, users, authz, api.Options{
+		WatchQueueSize:      *watchQueueSize,
+		WatchWindowSize:     *watchWindowSize,
+		WatchBackpressure:   backpressure,
+		WatchCoalesceWindow: *watchCoalesce,
+		Impersonate:         *impersonate,
+		ReverseProxy:        *reverseProxy,
+		FieldIndexes:        fieldIndexes,
+		CacheAllowlist:      cfg.CacheAllowlistKinds(),
+		InformerIdleTTL:     *informerIdleTTL,
+		OIDC:                oidcOptions(oidc),
+	})
+	succeedOrDie(err)
 
 	user := r.Group("/user")
 	{
 		user.POST("/login", a.Login)
 		user.DELETE("/logout/:name", a.Logout)
+		user.GET("/oidc/login", a.OIDCLogin)
+		user.GET("/oidc/callback", a.OIDCCallback)
 	}
 
 	apis := r.Group("/apis")
@@ -99,9 +179,136 @@ func main() {
 		core.DELETE("/:version/namespaces/:namespace/:resource/:name", a.DeleteObject)
 	}
 
+	admin := r.Group("/admin")
+	{
+		admin.GET("/informers", a.Informers)
+	}
+
+	if *reverseProxy {
+		r.NoRoute(a.Proxy)
+	}
+
+	if *tlsCertFile != "" {
+		// client certificates are requested, not required, bearer tokens still authenticate the others
+		server := &http.Server{Addr: ":8001", Handler: r, TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert}}
+		succeedOrDie(server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile))
+		return
+	}
 	r.Run(":8001")
 }
 
+func newUserStore(mgr ctrl.Manager) (user.UserStore, error) {
+	switch *userStore {
+	case "file":
+		return user.NewFileStore(*userFile)
+	case "secret":
+		namespace, name, ok := strings.Cut(*userSecret, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid --user-secret %q, expected namespace/name", *userSecret)
+		}
+		return user.NewSecretStore(mgr.GetClient(), mgr.GetAPIReader(), namespace, name), nil
+	default:
+		return nil, fmt.Errorf("unknown --user-store %q", *userStore)
+	}
+}
+
+// newAuthenticator chains the configured authenticators the way the apiserver does: client certificates first,
+// then bearer tokens by the static token file, the OpenID provider and ServiceAccount tokens.
+func newAuthenticator(mgr ctrl.Manager, oidc *authenticator.OIDC) (authenticator.Authenticator, error) {
+	var chain authenticator.Union
+	if *clientCAFile != "" {
+		x509, err := authenticator.NewX509FromFile(*clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, x509)
+	}
+
+	var tokens authenticator.UnionToken
+	if *tokenAuthFile != "" {
+		static, err := authenticator.NewStaticTokensFromFile(*tokenAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, static)
+	}
+	if oidc != nil {
+		tokens = append(tokens, oidc)
+	}
+	serviceAccounts, err := newServiceAccountAuthenticator(mgr)
+	if err != nil {
+		return nil, err
+	}
+	tokens = append(tokens, serviceAccounts)
+	return authenticator.NewAuthenticatedGroupAdder(append(chain, authenticator.NewBearerToken(tokens))), nil
+}
+
+func newServiceAccountAuthenticator(mgr ctrl.Manager) (authenticator.Token, error) {
+	tokenReview := authenticator.NewTokenReview(mgr.GetClient())
+	if !*localTokenVerification {
+		return tokenReview, nil
+	}
+	keys, err := authenticator.NewClusterKeySet(mgr.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+	var audiences []string
+	if *tokenAudiences != "" {
+		audiences = strings.Split(*tokenAudiences, ",")
+	}
+	return authenticator.NewServiceAccountToken(keys, audiences, mgr.GetClient(), tokenReview), nil
+}
+
+func newAuthorizer(mgr ctrl.Manager) (authorizer.Authorizer, error) {
+	switch *authorizationMode {
+	case "rbac":
+		return authorizer.NewRBACAuthorizer(mgr.GetClient()), nil
+	case "sar":
+		return authorizer.NewSubjectAccessReviewAuthorizer(mgr.GetClient(), *sarCacheTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown --authorization-mode %q", *authorizationMode)
+	}
+}
+
+func newOIDC() *authenticator.OIDC {
+	if *oidcIssuerURL == "" {
+		return nil
+	}
+	keys := authenticator.NewKeySet(http.DefaultClient, *oidcIssuerURL)
+	return authenticator.NewOIDC(keys, *oidcIssuerURL, *oidcClientID, authenticator.OIDCClaims{
+		UsernameClaim:  *oidcUserClaim,
+		UsernamePrefix: *oidcUserPrefix,
+		GroupsClaim:    *oidcGroupsClaim,
+		GroupsPrefix:   *oidcGroupsPrefix,
+	})
+}
+
+func oidcOptions(oidc *authenticator.OIDC) *api.OIDCOptions {
+	if oidc == nil {
+		return nil
+	}
+	return &api.OIDCOptions{
+		Provider:     oidc,
+		ClientID:     *oidcClientID,
+		ClientSecret: *oidcClientSecret,
+		RedirectURL:  *oidcRedirectURL,
+		Scopes:       strings.Split(*oidcScopes, ","),
+		Namespace:    *oidcNamespace,
+	}
+}
+
+func newTokenCache() (auth.TokenCache, error) {
+	switch *tokenCache {
+	case "memory":
+		return auth.NewMemoryTokenCache(context.Background(), *tokenCacheTTL, *tokenCacheSize), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr, Password: *redisPassword, DB: *redisDB})
+		return auth.NewRedisTokenCache(context.Background(), client, *tokenCacheTTL, *tokenCacheSize)
+	default:
+		return nil, fmt.Errorf("unknown --token-cache %q", *tokenCache)
+	}
+}
+
 func succeedOrDie(err error) {
 	if err != nil {
 		panic(err)
@@ -6,76 +6,174 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
 	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/user"
 	"io"
 	authv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
-	toolscache "k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/retry"
+	"mime"
 	"net/http"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// TODO database
-const (
-	UserName         = "admin"
-	Password         = "password"
-	DefaultNamespace = "default"
-)
+type Options struct {
+	// WatchQueueSize bounds the events queued for a single watcher.
+	WatchQueueSize int
+	// WatchWindowSize is the number of recent events kept per watched kind, watches resuming from an older
+	// resourceVersion get 410 Gone.
+	WatchWindowSize int
+	// WatchBackpressure decides what happens when a watcher's queue is full.
+	WatchBackpressure BackpressurePolicy
+	// WatchCoalesceWindow delays sending the changes of a list watch so bursts are coalesced.
+	WatchCoalesceWindow time.Duration
+	// Impersonate makes CRUD requests and watches reach the apiserver as the authenticated user instead of the proxy.
+	Impersonate bool
+	// ReverseProxy enables the Proxy handler for requests without a dedicated route.
+	ReverseProxy bool
+	// FieldIndexes are the fields indexed in the cache per kind, see IndexFields.
+	FieldIndexes map[runtimeschema.GroupVersionKind][]string
+	// CacheAllowlist are the kinds reads and watches may cache, any version of a kind whose Version is empty,
+	// any group or kind of a Group or Kind "*". Empty allows none.
+	CacheAllowlist []runtimeschema.GroupVersionKind
+	// InformerIdleTTL stops the informers neither watched nor read for that long, 0 keeps them forever.
+	InformerIdleTTL time.Duration
+	// OIDC enables logging in through an OpenID provider.
+	OIDC *OIDCOptions
+}
 
 type Api struct {
-	mgr ctrl.Manager
+	opts    Options
+	mgr     ctrl.Manager
+	users   user.UserStore
+	authz   authorizer.Authorizer
+	clients *clientPool
+	proxy   *reverseProxy
+	hub     *watchHub
+	rbac    *rbacChanges
+	// informers of the cache started for users
+	informers *informerTracker
+	oidc      *oidcLogin
 }
 
-func NewApi(mgr ctrl.Manager) *Api {
-	return &Api{mgr: mgr}
+func NewApi(mgr ctrl.Manager, users user.UserStore, authz authorizer.Authorizer, opts Options) (*Api, error) {
+	if opts.WatchQueueSize <= 0 {
+		opts.WatchQueueSize = defaultWatchQueueSize
+	}
+	if opts.WatchWindowSize <= 0 {
+		opts.WatchWindowSize = defaultWatchWindowSize
+	}
+	if opts.WatchBackpressure == "" {
+		opts.WatchBackpressure = BackpressureCoalesce
+	}
+	a := &Api{opts: opts, mgr: mgr, users: users, authz: authz, hub: newWatchHub(mgr.GetCache(), opts.WatchWindowSize)}
+	if err := metrics.Registry.Register(a.hub); err != nil {
+		return nil, err
+	}
+	rbac, err := newRBACChanges(context.Background(), mgr.GetCache(), authz)
+	if err != nil {
+		return nil, err
+	}
+	a.rbac = rbac
+	pinned := make([]runtimeschema.GroupVersionKind, 0, len(opts.FieldIndexes))
+	for gvk := range opts.FieldIndexes {
+		pinned = append(pinned, gvk)
+	}
+	a.informers = newInformerTracker(mgr.GetCache(), opts.InformerIdleTTL, pinned)
+	go a.informers.run(context.Background())
+	if opts.OIDC != nil {
+		a.oidc = newOIDCLogin(*opts.OIDC)
+	}
+	if opts.Impersonate {
+		a.clients = newClientPool(mgr.GetConfig(), mgr.GetScheme(), mgr.GetRESTMapper())
+	}
+	if opts.ReverseProxy {
+		proxy, err := newReverseProxy(mgr.GetConfig())
+		if err != nil {
+			return nil, err
+		}
+		a.proxy = proxy
+	}
+	return a, nil
 }
 
 func (a *Api) Login(c *gin.Context) {
-	user := &http_common.UserLoginRequest{}
-	err := c.ShouldBind(user)
+	req := &http_common.UserLoginRequest{}
+	err := c.ShouldBind(req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"msg": "bad request", "detail": err.Error()})
+		http_common.Error(c, apierrors.NewBadRequest(err.Error()))
 		return
 	}
-	if user.Name != UserName || user.Password != Password {
-		c.JSON(http.StatusForbidden, gin.H{"msg": "invalid username or password"})
+	u, err := a.users.Verify(c.Request.Context(), req.Name, req.Password)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) || errors.Is(err, user.ErrInvalidPassword) || errors.Is(err, user.ErrDisabled) {
+			http_common.Error(c, apierrors.NewUnauthorized("invalid username or password"))
+			return
+		}
+		fmt.Printf("verify user error: %s\n", err)
+		http_common.Error(c, err)
 		return
 	}
 
-	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: DefaultNamespace, Name: user.Name}}
-	err = a.mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Name: user.Name, Namespace: DefaultNamespace}, sa)
-	if err == nil {
-		err = a.mgr.GetClient().Delete(c.Request.Context(), sa)
-		if err != nil {
-			fmt.Printf("delete serviceaccount error: %s\n", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+	a.loginServiceAccount(c, u)
+}
+
+// loginServiceAccount makes sure the ServiceAccount of the user exists in its home namespace,
+// creating it on first login, and responds with a token issued for it.
+func (a *Api) loginServiceAccount(c *gin.Context, u *user.User) {
+	namespace := u.HomeNamespace()
+	err := a.mgr.GetAPIReader().Get(c.Request.Context(), types.NamespacedName{Name: namespace}, &corev1.Namespace{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			http_common.Error(c, &apierrors.StatusError{ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusNotFound,
+				Reason:  metav1.StatusReasonNotFound,
+				Message: fmt.Sprintf("home namespace %q of user %q does not exist", namespace, u.Name),
+				Details: &metav1.StatusDetails{Name: namespace, Kind: "namespaces"},
+			}})
+			return
+		}
+		fmt.Printf("get namespace error: %s\n", err)
+		http_common.Error(c, err)
+		return
+	}
+
+	key := types.NamespacedName{Namespace: namespace, Name: u.Name}
+	sa := &corev1.ServiceAccount{}
+	err = a.mgr.GetClient().Get(c.Request.Context(), key, sa)
+	if apierrors.IsNotFound(err) {
+		sa = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: u.Name}}
+		err = a.mgr.GetClient().Create(c.Request.Context(), sa)
+		if apierrors.IsAlreadyExists(err) {
+			err = a.mgr.GetAPIReader().Get(c.Request.Context(), key, sa)
 		}
-		sa.ResourceVersion = ""
 	}
-	err = a.mgr.GetClient().Create(c.Request.Context(), sa)
 	if err != nil {
-		//TODO log
-		fmt.Printf("create serviceaccount error: %s\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		fmt.Printf("get or create serviceaccount error: %s\n", err)
+		http_common.Error(c, err)
 		return
 	}
 
 	expireTime := int64(3600)
 	token := &authv1.TokenRequest{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: user.Name,
+			Name:      u.Name,
+			Namespace: namespace,
 		},
 		Spec: authv1.TokenRequestSpec{
 			ExpirationSeconds: &expireTime,
@@ -84,11 +182,20 @@ func (a *Api) Login(c *gin.Context) {
 	err = a.mgr.GetClient().SubResource("token").Create(c.Request.Context(), sa, token)
 	if err != nil {
 		fmt.Printf("create token error: %s\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		http_common.Error(c, err)
 		return
 	}
 	resp := &http_common.UserLoginResponse{Token: token.Status.Token}
-	auth.Cache.Store(token.Status.Token[:32], &auth.UserInfo{Name: user.Name, Namespace: DefaultNamespace, RenewTime: time.Now()})
+	err = auth.Cache.Set(c.Request.Context(), token.Status.Token, &auth.UserInfo{
+		Username:   auth.ServiceAccountUsername(namespace, u.Name),
+		Groups:     append(auth.ServiceAccountGroups(namespace), u.Groups...),
+		Name:       u.Name,
+		Namespace:  namespace,
+		Namespaces: u.AllNamespaces(),
+	})
+	if err != nil {
+		fmt.Printf("cache token error: %s\n", err)
+	}
 
 	c.JSON(http.StatusOK, resp)
 }
@@ -96,24 +203,51 @@ func (a *Api) Login(c *gin.Context) {
 func (a *Api) Logout(c *gin.Context) {
 	name := c.Param("name")
 	if name == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"msg": "bad request", "detail": "name can be set"})
+		http_common.Error(c, apierrors.NewBadRequest("name must be set"))
+		return
+	}
+	// the ServiceAccount is deleted with the proxy's credentials, so users may only log themselves out
+	userInfo := c.MustGet(auth.ContextKey).(*auth.UserInfo)
+	forbidden := apierrors.NewForbidden(runtimeschema.GroupResource{Resource: "users"}, name, errors.New("users may only log themselves out"))
+	if name != userInfo.Name || userInfo.Namespace == "" {
+		http_common.Error(c, forbidden)
+		return
+	}
+	u, err := a.users.Get(c.Request.Context(), name)
+	if errors.Is(err, user.ErrNotFound) {
+		http_common.Error(c, forbidden)
+		return
+	}
+	if err != nil {
+		fmt.Printf("get user error: %s\n", err)
+		http_common.Error(c, err)
+		return
+	}
+	namespace := u.HomeNamespace()
+	if namespace != userInfo.Namespace {
+		http_common.Error(c, forbidden)
 		return
 	}
 	sa := &corev1.ServiceAccount{}
-	err := a.mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Namespace: DefaultNamespace, Name: name}, sa)
+	err = a.mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Namespace: namespace, Name: name}, sa)
 	if err != nil {
 		fmt.Printf("get serviceaccount error: %s\n", err)
-		c.JSON(http.StatusNotFound, gin.H{"msg": "not found"})
+		http_common.Error(c, err)
 		return
 	}
 	err = a.mgr.GetClient().Delete(c.Request.Context(), sa)
 	if err != nil {
 		fmt.Printf("delete serviceaccount error: %s\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		http_common.Error(c, err)
 		return
 	}
 
-	auth.Cache.Delete(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")[:32])
+	err = auth.Cache.Delete(c.Request.Context(), strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	if err != nil {
+		fmt.Printf("revoke token error: %s\n", err)
+		http_common.Error(c, err)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"msg": "success"})
 }
@@ -124,24 +258,24 @@ func (a *Api) GetObjectList(c *gin.Context) {
 		a.errorParseHandler(c, err)
 		return
 	}
-	watch := c.Query("watch")
-	if watch == "true" {
+	if http_common.IsWatch(c.Request) {
 		a.WatchList(c)
 		return
 	}
 
 	namespace := a.parseNamespace(c)
-	listOptions, err := a.parseListOptions(c)
+	listOptions, fieldSelector, err := a.parseListOptions(c)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	if namespace != "" {
-		err = a.mgr.GetClient().List(context.Background(), objList, client.InNamespace(namespace), listOptions)
-	} else {
-		err = a.mgr.GetClient().List(context.Background(), objList, listOptions)
+	fromCache, err := a.listFromCache(c, objList.GroupVersionKind(), listOptions.Continue)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
 	}
+	err = a.list(c, objList, namespace, listOptions, fieldSelector, fromCache)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
@@ -155,13 +289,27 @@ func (a *Api) GetObject(c *gin.Context) {
 		a.errorParseHandler(c, err)
 		return
 	}
-	watch := c.Query("watch")
-	if watch == "true" {
+	if http_common.IsWatch(c.Request) {
 		a.WatchGet(c)
 		return
 	}
 
-	err = a.mgr.GetClient().Get(context.Background(), a.getNamespacedName(c), obj)
+	fromCache, err := a.readFromCache(c, obj.GroupVersionKind())
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	var reader client.Reader = a.mgr.GetClient()
+	if fromCache {
+		a.informers.touch(obj.GroupVersionKind())
+	} else {
+		reader, err = a.liveReader(c)
+		if err != nil {
+			a.errorResponseHandler(c, err)
+			return
+		}
+	}
+	err = reader.Get(context.Background(), a.getNamespacedName(c), obj, &client.GetOptions{Raw: &metav1.GetOptions{ResourceVersion: c.Query("resourceVersion")}})
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
@@ -171,20 +319,35 @@ func (a *Api) GetObject(c *gin.Context) {
 }
 
 func (a *Api) CreateObject(c *gin.Context) {
+	gvk, err := a.parseGVR(c)
+	if err != nil {
+		a.errorParseHandler(c, err)
+		return
+	}
 	obj := &unstructured.Unstructured{}
-	err := c.Bind(obj)
+	err = c.ShouldBind(obj)
+	if err != nil {
+		a.errorResponseHandler(c, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	err = a.checkBodyObject(c, gvk, obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	err = a.mgr.GetClient().Create(context.Background(), obj)
+	cli, err := a.client(c)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	err = cli.Create(context.Background(), obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"msg": fmt.Sprintf("%s/%s created", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())})
+	c.JSON(http.StatusCreated, obj)
 }
 
 func (a *Api) DeleteObject(c *gin.Context) {
@@ -194,36 +357,78 @@ func (a *Api) DeleteObject(c *gin.Context) {
 		return
 	}
 
-	err = a.mgr.GetClient().Get(context.Background(), a.getNamespacedName(c), obj)
+	cli, err := a.client(c)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	reader, err := a.liveReader(c)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	err = reader.Get(context.Background(), a.getNamespacedName(c), obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	err = a.mgr.GetClient().Delete(context.Background(), obj)
+	err = cli.Delete(context.Background(), obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"msg": fmt.Sprintf("%s/%s deleted", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())})
+	// like the apiserver, return the object while finalizers or graceful deletion keep it around,
+	// and a success status once it is gone
+	gvk := obj.GroupVersionKind()
+	details := &metav1.StatusDetails{Name: obj.GetName(), Group: gvk.Group, Kind: c.Param("resource"), UID: obj.GetUID()}
+	err = reader.Get(context.Background(), a.getNamespacedName(c), obj)
+	if err == nil {
+		c.JSON(http.StatusOK, obj)
+		return
+	}
+	if !apierrors.IsNotFound(err) {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+		Details:  details,
+	})
 }
 
 func (a *Api) UpdateObject(c *gin.Context) {
+	gvk, err := a.parseGVR(c)
+	if err != nil {
+		a.errorParseHandler(c, err)
+		return
+	}
 	obj := &unstructured.Unstructured{}
-	err := c.Bind(obj)
+	err = c.ShouldBind(obj)
+	if err != nil {
+		a.errorResponseHandler(c, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	err = a.checkBodyObject(c, gvk, obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	err = a.mgr.GetClient().Update(context.Background(), obj)
+	cli, err := a.client(c)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	err = cli.Update(context.Background(), obj)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"msg": fmt.Sprintf("%s/%s updated", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())})
+	c.JSON(http.StatusOK, obj)
 }
 
 func (a *Api) PatchObject(c *gin.Context) {
@@ -233,102 +438,177 @@ func (a *Api) PatchObject(c *gin.Context) {
 		return
 	}
 
-	err = a.mgr.GetClient().Get(context.Background(), a.getNamespacedName(c), obj)
+	patchType, err := a.parsePatchType(c)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
-	bodyBytes, err := io.ReadAll(c.Request.Body)
+	patchOptions, err := a.parsePatchOptions(c)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	err = a.mgr.GetClient().Patch(context.Background(), obj, client.RawPatch(types.StrategicMergePatchType, bodyBytes))
+	cli, err := a.client(c)
+	if err != nil {
+		a.errorResponseHandler(c, err)
+		return
+	}
+	// no need to read the object first, server-side apply may even create it
+	namespacedName := a.getNamespacedName(c)
+	obj.SetNamespace(namespacedName.Namespace)
+	obj.SetName(namespacedName.Name)
+	bodyBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		a.errorResponseHandler(c, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+
+	err = cli.Patch(context.Background(), obj, client.RawPatch(patchType, bodyBytes), patchOptions)
 	if err != nil {
 		a.errorResponseHandler(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"msg": fmt.Sprintf("%s/%s patched", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())})
+	c.JSON(http.StatusOK, obj)
 }
 
 func (a *Api) WatchGet(c *gin.Context) {
 	obj, _ := a.getUnstructuredObj(c)
-	informer, err := a.mgr.GetCache().GetInformerForKind(c.Request.Context(), obj.GetObjectKind().GroupVersionKind())
+	if http_common.WantsWatchEvents(c.Request) {
+		a.watchEvents(c, obj.GroupVersionKind(), a.parseNamespace(c), a.parseName(c), nil, nil)
+		return
+	}
+
+	e := &WatchEventHandler{Name: a.parseName(c), Namespace: a.parseNamespace(c)}
+	queue, stop, err := a.startWatch(c, obj.GroupVersionKind(), e)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		http_common.Error(c, err)
 		return
 	}
+	defer stop()
 
-	e := &EventHandler{FirstTime: true, Sig: make(chan struct{})}
-	registration, err := informer.AddEventHandler(e)
+	// the object is read where its events come from, the cache or the apiserver as the user
+	reader, err := a.client(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		http_common.Error(c, err)
 		return
 	}
-	defer func() {
-		a.removeEventHandler(informer, registration)
-	}()
 
-	c.Stream(func(w io.Writer) bool {
+	rbacChanged := a.rbac.changes()
+	for {
 		select {
-		case <-e.Sig:
-			err = a.mgr.GetClient().Get(context.Background(), a.getNamespacedName(c), obj)
+		case <-c.Request.Context().Done():
+			return
+		case <-rbacChanged:
+			rbacChanged = a.rbac.changes()
+			if err := a.reauthorize(c); err != nil {
+				c.SSEvent("error", http_common.ErrorStatus(err))
+				c.Writer.Flush()
+				return
+			}
+		case <-queue.notify:
+			if _, err := queue.pop(); err != nil {
+				if err != errWatchClosed {
+					c.SSEvent("error", http_common.ErrorStatus(err))
+					c.Writer.Flush()
+				}
+				return
+			}
+			err = reader.Get(context.Background(), a.getNamespacedName(c), obj)
 			if err != nil {
-				if apierrors.IsNotFound(err) {
-					c.SSEvent("message", nil)
-					return true
+				if !apierrors.IsNotFound(err) {
+					return
 				}
-				return false
+				c.SSEvent("message", nil)
+			} else {
+				c.SSEvent("message", obj)
 			}
-			e.Namespace = obj.GetNamespace()
-			e.Name = obj.GetName()
-			c.SSEvent("message", obj)
-		default:
-			time.Sleep(1 * time.Second)
+			c.Writer.Flush()
 		}
-		return true
-	})
+	}
 }
 
 func (a *Api) WatchList(c *gin.Context) {
 	objList, _ := a.getUnstructuredObjList(c)
 	namespace := a.parseNamespace(c)
-	listOptions, err := a.parseListOptions(c)
+	listOptions, fieldSelector, err := a.parseListOptions(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		a.errorResponseHandler(c, err)
+		return
+	}
+	if http_common.WantsWatchEvents(c.Request) {
+		a.watchEvents(c, objList.GroupVersionKind(), namespace, "", listOptions.LabelSelector, fieldSelector)
 		return
 	}
 
-	informer, err := a.mgr.GetCache().GetInformerForKind(c.Request.Context(), objList.GetObjectKind().GroupVersionKind())
-	e := &EventHandler{FirstTime: true, Sig: make(chan struct{}), Namespace: namespace}
-	registration, err := informer.AddEventHandler(e)
+	sendInitialList, _ := strconv.ParseBool(c.Query("sendInitialList"))
+	e := &WatchEventHandler{Namespace: namespace, LabelSelector: listOptions.LabelSelector, FieldSelector: fieldSelector, SkipInitialList: true}
+	queue, stop, err := a.startWatch(c, objList.GroupVersionKind(), e)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
+		http_common.Error(c, err)
 		return
 	}
-	defer func() {
-		a.removeEventHandler(informer, registration)
-	}()
+	defer stop()
 
-	c.Stream(func(w io.Writer) bool {
+	// the handler is registered before listing, so no change is missed between the snapshot and the deltas
+	if sendInitialList {
+		// the snapshot is never paged and comes from where the deltas come from, the cache or the apiserver
+		// as the user, they would not make sense on a partial or newer list
+		snapshotOptions := *listOptions
+		snapshotOptions.Limit, snapshotOptions.Continue = 0, ""
+		err = a.list(c, objList, namespace, &snapshotOptions, fieldSelector, a.clients == nil)
+		if err != nil {
+			http_common.Error(c, err)
+			return
+		}
+		c.SSEvent("snapshot", objList)
+		c.Writer.Flush()
+	}
+
+	rbacChanged := a.rbac.changes()
+	for {
 		select {
-		case <-e.Sig:
-			if namespace != "" {
-				err = a.mgr.GetClient().List(context.Background(), objList, client.InNamespace(namespace), listOptions)
-			} else {
-				err = a.mgr.GetClient().List(context.Background(), objList, listOptions)
+		case <-c.Request.Context().Done():
+			return
+		case <-rbacChanged:
+			rbacChanged = a.rbac.changes()
+			if err := a.reauthorize(c); err != nil {
+				c.SSEvent("error", http_common.ErrorStatus(err))
+				c.Writer.Flush()
+				return
+			}
+		case <-queue.notify:
+			// let bursts within the window pile up and send them as one coalesced batch
+			if a.opts.WatchCoalesceWindow > 0 {
+				select {
+				case <-c.Request.Context().Done():
+					return
+				case <-time.After(a.opts.WatchCoalesceWindow):
+				}
+			}
+			events, err := queue.pop()
+			for _, event := range coalesceEvents(events) {
+				c.SSEvent("message", &metav1.WatchEvent{Type: string(event.Type), Object: runtime.RawExtension{Object: event.Object}})
 			}
 			if err != nil {
-				return false
+				if err != errWatchClosed {
+					c.SSEvent("error", http_common.ErrorStatus(err))
+				}
+				c.Writer.Flush()
+				return
 			}
-			c.SSEvent("message", objList)
-		default:
-			time.Sleep(1 * time.Second)
+			c.Writer.Flush()
 		}
-		return true
-	})
+	}
+}
+
+// client returns the client CRUD requests go through, impersonating the authenticated user if enabled.
+func (a *Api) client(c *gin.Context) (client.Client, error) {
+	if a.clients == nil {
+		return a.mgr.GetClient(), nil
+	}
+	return a.clients.clientFor(c.MustGet(auth.ContextKey).(*auth.UserInfo))
 }
 
 func (a *Api) parseGVR(c *gin.Context) (runtimeschema.GroupVersionKind, error) {
@@ -377,6 +657,39 @@ func (a *Api) getUnstructuredObj(c *gin.Context) (*unstructured.Unstructured, er
 	return obj, nil
 }
 
+// checkBodyObject makes the object of a create or update the one on the URL, which is all the authorizer saw.
+// An empty apiVersion, namespace or name is taken from the URL, any other mismatch is rejected as the apiserver does.
+func (a *Api) checkBodyObject(c *gin.Context, gvk runtimeschema.GroupVersionKind, obj *unstructured.Unstructured) error {
+	if obj.GetAPIVersion() == "" {
+		obj.SetAPIVersion(gvk.GroupVersion().String())
+	}
+	if obj.GetAPIVersion() != gvk.GroupVersion().String() {
+		return apierrors.NewBadRequest(fmt.Sprintf("the API version in the data (%s) does not match the expected API version (%s)", obj.GetAPIVersion(), gvk.GroupVersion()))
+	}
+	if obj.GetKind() != gvk.Kind {
+		return apierrors.NewBadRequest(fmt.Sprintf("the kind in the data (%s) does not match the expected kind (%s)", obj.GetKind(), gvk.Kind))
+	}
+
+	namespacedName := a.getNamespacedName(c)
+	if namespacedName.Namespace != "" {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespacedName.Namespace)
+		}
+		if obj.GetNamespace() != namespacedName.Namespace {
+			return apierrors.NewBadRequest("the namespace of the provided object does not match the namespace sent on the request")
+		}
+	}
+	if namespacedName.Name != "" {
+		if obj.GetName() == "" {
+			obj.SetName(namespacedName.Name)
+		}
+		if obj.GetName() != namespacedName.Name {
+			return apierrors.NewBadRequest(fmt.Sprintf("the name of the object (%s) does not match the name on the URL (%s)", obj.GetName(), namespacedName.Name))
+		}
+	}
+	return nil
+}
+
 func (a *Api) getUnstructuredObjList(c *gin.Context) (*unstructured.UnstructuredList, error) {
 	gvk, err := a.parseGVR(c)
 	if err != nil {
@@ -389,63 +702,167 @@ func (a *Api) getUnstructuredObjList(c *gin.Context) (*unstructured.Unstructured
 	return objList, nil
 }
 
-func (a *Api) parseListOptions(c *gin.Context) (*client.ListOptions, error) {
+// parseListOptions parses the limit and selectors of a list or watch. The field selector is returned apart,
+// list splits it between the cache indexes and in-memory filtering.
+func (a *Api) parseListOptions(c *gin.Context) (*client.ListOptions, fields.Selector, error) {
 	var err error
-	limitNum := 500
+	// like the apiserver, lists are only paged when asked to
+	limitNum := 0
 
 	limit := c.Query("limit")
 	if limit != "" {
 		limitNum, err = strconv.Atoi(limit)
 		if err != nil {
-			return nil, err
+			return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("invalid limit %q: %s", limit, err))
+		}
+	}
+
+	var fieldSelector fields.Selector
+	if selector := c.Query("fieldSelector"); selector != "" {
+		fieldSelector, err = fields.ParseSelector(selector)
+		if err != nil {
+			return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("invalid fieldSelector %q: %v", selector, err))
+		}
+	}
+
+	labelSelector := labels.Everything()
+	if selector := c.Query("labelSelector"); selector != "" {
+		labelSelector, err = labels.Parse(selector)
+		if err != nil {
+			return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("invalid labelSelector %q: %v", selector, err))
+		}
+	}
+
+	return &client.ListOptions{Limit: int64(limitNum), Continue: c.Query("continue"), LabelSelector: labelSelector}, fieldSelector, nil
+}
+
+// list lists objList a page at a time. Cached lists are read with the exact matches on indexed fields answered
+// by the cache indexes, and paged by the proxy, the rest of fieldSelector is evaluated here. Other lists are read
+// from the apiserver, which pages them and evaluates the field selectors it supports.
+func (a *Api) list(c *gin.Context, objList *unstructured.UnstructuredList, namespace string, listOptions *client.ListOptions, fieldSelector fields.Selector, fromCache bool) error {
+	opts := *listOptions
+	opts.Namespace = namespace
+
+	if !fromCache {
+		reader, err := a.liveReader(c)
+		if err != nil {
+			return err
+		}
+		// the client writes the selectors into Raw, every request needs its own
+		raw := func() *metav1.ListOptions {
+			return &metav1.ListOptions{ResourceVersion: c.Query("resourceVersion"), ResourceVersionMatch: metav1.ResourceVersionMatch(c.Query("resourceVersionMatch"))}
+		}
+		opts.Raw = raw()
+		opts.FieldSelector = fieldSelector
+		err = reader.List(c.Request.Context(), objList, &opts)
+		if err == nil || fieldSelector == nil || !apierrors.IsBadRequest(err) {
+			return err
+		}
+		// the apiserver selects on metadata.name and metadata.namespace of every kind, on other fields for a few
+		// kinds only; when it rejects the selector, those are evaluated here
+		generic, rest := splitGenericFieldSelector(fieldSelector)
+		if rest == nil {
+			return err
 		}
+		opts.Raw, opts.FieldSelector = raw(), generic
+		err = reader.List(c.Request.Context(), objList, &opts)
+		if err != nil {
+			return err
+		}
+		filterFields(objList, rest)
+		// pages may come out shorter than the limit, as upstream allows, but the count no longer holds
+		objList.SetRemainingItemCount(nil)
+		return nil
 	}
 
-	labelSelector := c.Query("labelSelector")
-	if labelSelector == "" {
-		return &client.ListOptions{Limit: int64(limitNum), LabelSelector: labels.Everything()}, nil
+	a.informers.touch(objList.GroupVersionKind())
+	indexed, rest := a.splitFieldSelector(objList.GroupVersionKind(), fieldSelector)
+	opts.FieldSelector = indexed
+	opts.Limit, opts.Continue = 0, ""
+	err := a.mgr.GetClient().List(c.Request.Context(), objList, &opts)
+	if err != nil {
+		return err
 	}
+	if rest != nil {
+		filterFields(objList, rest)
+	}
+	return paginate(objList, listOptions.Limit, listOptions.Continue)
+}
 
-	selectorList := []string{labelSelector}
-	if strings.Contains(labelSelector, ",") {
-		selectorList = strings.Split(labelSelector, ",")
+// listFromCache tells whether a list is read from the cache, lists continued with a token of the proxy always are.
+func (a *Api) listFromCache(c *gin.Context, gvk runtimeschema.GroupVersionKind, continueToken string) (bool, error) {
+	if continueToken != "" {
+		return a.clients == nil && a.cacheAllowed(gvk) && isCacheContinue(continueToken), nil
 	}
-	selectors := make(map[string]string, len(selectorList))
-	for _, selector := range selectorList {
-		keyValues := strings.Split(selector, "=")
-		if len(keyValues) != 2 {
-			return nil, errors.New("bad request")
+	return a.readFromCache(c, gvk)
+}
+
+func filterFields(objList *unstructured.UnstructuredList, selector fields.Selector) {
+	items := objList.Items[:0]
+	for _, item := range objList.Items {
+		if matchFields(selector, &item) {
+			items = append(items, item)
 		}
-		selectors[keyValues[0]] = keyValues[1]
 	}
-	// TODO filedSelector
+	objList.Items = items
+}
 
-	return &client.ListOptions{Limit: int64(limitNum), LabelSelector: labels.SelectorFromValidatedSet(selectors)}, nil
+var patchContentTypes = map[string]types.PatchType{
+	string(types.JSONPatchType):           types.JSONPatchType,
+	string(types.MergePatchType):          types.MergePatchType,
+	string(types.StrategicMergePatchType): types.StrategicMergePatchType,
+	string(types.ApplyPatchType):          types.ApplyPatchType,
 }
 
-func (a *Api) removeEventHandler(informer cache.Informer, handler toolscache.ResourceEventHandlerRegistration) {
-	for {
-		err := retry.OnError(retry.DefaultRetry, func(err error) bool {
-			return err != nil
-		}, func() error {
-			return informer.RemoveEventHandler(handler)
-		})
-		if err == nil {
-			fmt.Println("eventHandler removed")
-			return
+func (a *Api) parsePatchType(c *gin.Context) (types.PatchType, error) {
+	contentType := c.GetHeader("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if patchType, ok := patchContentTypes[mediaType]; ok {
+			return patchType, nil
+		}
+	}
+	return "", &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusUnsupportedMediaType,
+		Reason:  metav1.StatusReasonUnsupportedMediaType,
+		Message: fmt.Sprintf("the body of the request was in an unknown format - accepted media types include: %s, %s, %s, %s", types.JSONPatchType, types.MergePatchType, types.StrategicMergePatchType, types.ApplyPatchType),
+		Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{{Type: metav1.CauseTypeFieldValueNotSupported, Message: contentType, Field: "Content-Type"}}},
+	}}
+}
+
+func (a *Api) parsePatchOptions(c *gin.Context) (*client.PatchOptions, error) {
+	patchOptions := &client.PatchOptions{FieldManager: c.Query("fieldManager")}
+	if force := c.Query("force"); force != "" {
+		forced, err := strconv.ParseBool(force)
+		if err != nil {
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid force %q: %s", force, err))
 		}
-		fmt.Printf("remove eventHandler error: %s\n", err)
+		patchOptions.Force = &forced
 	}
+	return patchOptions, nil
 }
 
+// errorResponseHandler responds with the status of API errors. Errors of the request are returned as BadRequest
+// API errors, anything else, like a failing connection to the apiserver or an unsynced cache, is an internal error.
 func (a *Api) errorResponseHandler(c *gin.Context, err error) {
-	if apierrors.IsNotFound(err) {
-		c.JSON(http.StatusNotFound, gin.H{"msg": err.Error()})
-		return
+	var apiStatus apierrors.APIStatus
+	if !errors.As(err, &apiStatus) {
+		err = apierrors.NewInternalError(err)
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+	http_common.Error(c, err)
 }
 
+// errorParseHandler responds to resources the RESTMapper does not know about.
 func (a *Api) errorParseHandler(c *gin.Context, err error) {
-	c.JSON(http.StatusNotFound, gin.H{"msg": err.Error()})
+	if meta.IsNoMatchError(err) {
+		err = &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusNotFound,
+			Reason:  metav1.StatusReasonNotFound,
+			Message: "the server could not find the requested resource",
+			Details: &metav1.StatusDetails{Group: c.Param("group"), Kind: c.Param("resource")},
+		}}
+	}
+	http_common.Error(c, err)
 }
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var (
+	podGVK    = corev1.SchemeGroupVersion.WithKind("Pod")
+	secretGVK = corev1.SchemeGroupVersion.WithKind("Secret")
+)
+
+// testManager serves cached reads from cached and live reads from live, both fake clients.
+type testManager struct {
+	ctrl.Manager
+	cached client.WithWatch
+	live   client.WithWatch
+	cache  *testCache
+	mapper meta.RESTMapper
+}
+
+func (m *testManager) GetClient() client.Client       { return m.cached }
+func (m *testManager) GetAPIReader() client.Reader    { return m.live }
+func (m *testManager) GetCache() cache.Cache          { return m.cache }
+func (m *testManager) GetRESTMapper() meta.RESTMapper { return m.mapper }
+
+// testCache has fake informers and reads from the cached client.
+type testCache struct {
+	*informertest.FakeInformers
+	reader client.Reader
+}
+
+func (c *testCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	return c.reader.Get(ctx, key, obj, opts...)
+}
+
+func (c *testCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.reader.List(ctx, list, opts...)
+}
+
+// testReads counts the reads of a fake client.
+type testReads struct {
+	gets, lists atomic.Int32
+}
+
+func (r *testReads) funcs(funcs interceptor.Funcs) interceptor.Funcs {
+	get, listFn := funcs.Get, funcs.List
+	funcs.Get = func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+		r.gets.Add(1)
+		if get != nil {
+			return get(ctx, c, key, obj, opts...)
+		}
+		return c.Get(ctx, key, obj, opts...)
+	}
+	funcs.List = func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+		r.lists.Add(1)
+		if listFn != nil {
+			return listFn(ctx, c, list, opts...)
+		}
+		return c.List(ctx, list, opts...)
+	}
+	return funcs
+}
+
+type testApi struct {
+	*Api
+	router *gin.Engine
+	// reads of the cache and of the apiserver
+	cached, live testReads
+}
+
+type testApiOptions struct {
+	opts    Options
+	authz   authorizer.Authorizer
+	objects []client.Object
+	// live intercepts the calls to the apiserver
+	live interceptor.Funcs
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(context.Context, *authorizer.Attributes) (bool, error) {
+	return true, nil
+}
+
+// newTestApi routes the object handlers like main, behind an authorization of the attributes of each request
+// for a fixed user. The cache and the apiserver both start with the objects.
+func newTestApi(t *testing.T, o testApiOptions) *testApi {
+	gin.SetMode(gin.TestMode)
+	if o.authz == nil {
+		o.authz = allowAll{}
+	}
+	ta := &testApi{}
+	cached := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(o.objects...).
+		WithInterceptorFuncs(ta.cached.funcs(interceptor.Funcs{})).Build()
+	live := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(o.objects...).
+		WithInterceptorFuncs(ta.live.funcs(o.live)).Build()
+	mapper := meta.NewDefaultRESTMapper([]runtimeschema.GroupVersion{corev1.SchemeGroupVersion})
+	mapper.Add(podGVK, meta.RESTScopeNamespace)
+	mapper.Add(secretGVK, meta.RESTScopeNamespace)
+	c := &testCache{FakeInformers: &informertest.FakeInformers{}, reader: cached}
+	mgr := &testManager{cached: cached, live: live, cache: c, mapper: mapper}
+
+	if o.opts.WatchQueueSize <= 0 {
+		o.opts.WatchQueueSize = defaultWatchQueueSize
+	}
+	if o.opts.WatchBackpressure == "" {
+		o.opts.WatchBackpressure = BackpressureCoalesce
+	}
+	ta.Api = &Api{
+		opts:      o.opts,
+		mgr:       mgr,
+		authz:     o.authz,
+		hub:       newWatchHub(c, defaultWatchWindowSize),
+		rbac:      &rbacChanges{authz: o.authz, changed: make(chan struct{})},
+		informers: newInformerTracker(c, 0, nil),
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		userInfo := &auth.UserInfo{Username: "test"}
+		c.Set(auth.ContextKey, userInfo)
+		attrs := authorizer.NewAttributes(c.Request)
+		attrs.User = userInfo
+		allowed, err := o.authz.Authorize(c.Request.Context(), attrs)
+		if err != nil || !allowed {
+			http_common.AbortWithError(c, authorizer.Forbidden(attrs))
+			return
+		}
+		c.Set(authorizer.ContextKey, attrs)
+	})
+	core := r.Group("/api")
+	core.GET("/:version/:resource", ta.GetObjectList)
+	core.GET("/:version/:resource/:name", ta.GetObject)
+	core.GET("/:version/namespaces/:namespace/:resource", ta.GetObjectList)
+	core.GET("/:version/namespaces/:namespace/:resource/:name", ta.GetObject)
+	core.POST("/:version/namespaces/:namespace/:resource", ta.CreateObject)
+	core.PUT("/:version/namespaces/:namespace/:resource/:name", ta.UpdateObject)
+	ta.router = r
+	return ta
+}
+
+// do serves req, requests that never end, like watches, are cancelled with ctx.
+func (ta *testApi) do(ctx context.Context, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ta.router.ServeHTTP(w, req.WithContext(ctx))
+	return w
+}
+
+func testPod(name string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"app": name}}}
+}
+
+func TestListFieldSelectorFallback(t *testing.T) {
+	running := testPod("a")
+	running.Status.Phase = corev1.PodRunning
+	pending := testPod("b")
+	pending.Status.Phase = corev1.PodPending
+
+	// like for custom resources, the apiserver only selects on the metadata fields
+	var sent []string
+	live := interceptor.Funcs{List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+		listOptions := (&client.ListOptions{}).ApplyOptions(opts)
+		selector := listOptions.AsListOptions().FieldSelector
+		sent = append(sent, selector)
+		for _, requirement := range strings.Split(selector, ",") {
+			if requirement != "" && !strings.HasPrefix(requirement, "metadata.") {
+				return apierrors.NewBadRequest(fmt.Sprintf("field label not supported: %s", requirement))
+			}
+		}
+		return c.List(ctx, list, client.InNamespace(listOptions.Namespace))
+	}}
+
+	for _, tc := range []struct {
+		fieldSelector string
+		sent          []string
+	}{
+		{"status.phase=Running", []string{"status.phase=Running", ""}},
+		{"metadata.name=a,status.phase=Running", []string{"metadata.name=a,status.phase=Running", "metadata.name=a"}},
+	} {
+		sent = nil
+		ta := newTestApi(t, testApiOptions{objects: []client.Object{running, pending}, live: live})
+		w := ta.do(context.Background(), httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?fieldSelector="+url.QueryEscape(tc.fieldSelector), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tc.fieldSelector, w.Code, w.Body)
+		}
+		if !slices.Equal(sent, tc.sent) {
+			t.Errorf("%s: sent the field selectors %q, expected %q", tc.fieldSelector, sent, tc.sent)
+		}
+		list := &corev1.PodList{}
+		if err := json.Unmarshal(w.Body.Bytes(), list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) != 1 || list.Items[0].Name != "a" {
+			t.Errorf("%s: unexpected items %v", tc.fieldSelector, list.Items)
+		}
+	}
+}
+
+func TestListUnpagedByDefault(t *testing.T) {
+	objects := make([]client.Object, 0, 600)
+	for i := 0; i < cap(objects); i++ {
+		objects = append(objects, testPod(fmt.Sprintf("pod-%d", i)))
+	}
+	ta := newTestApi(t, testApiOptions{objects: objects, opts: Options{CacheAllowlist: []runtimeschema.GroupVersionKind{podGVK}}})
+
+	for _, query := range []string{"", "?resourceVersion=0"} {
+		w := ta.do(context.Background(), httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: %d %s", query, w.Code, w.Body)
+		}
+		list := &corev1.PodList{}
+		if err := json.Unmarshal(w.Body.Bytes(), list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) != len(objects) || list.Continue != "" {
+			t.Errorf("%q: got %d items and continue %q, expected all %d", query, len(list.Items), list.Continue, len(objects))
+		}
+	}
+	if ta.cached.lists.Load() != 1 || ta.live.lists.Load() != 1 {
+		t.Errorf("expected a live and a cached list, got %d and %d", ta.live.lists.Load(), ta.cached.lists.Load())
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	live := interceptor.Funcs{Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+		return fmt.Errorf("dial tcp 10.0.0.1:443: connect: connection refused")
+	}}
+	ta := newTestApi(t, testApiOptions{objects: []client.Object{testPod("a")}, live: live})
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+		reason             metav1.StatusReason
+	}{
+		// failures of the apiserver or the cache are not the fault of the request
+		{http.MethodGet, "/api/v1/namespaces/default/pods/a", "", http.StatusInternalServerError, metav1.StatusReasonInternalError},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?limit=ten", "", http.StatusBadRequest, metav1.StatusReasonBadRequest},
+		{http.MethodPost, "/api/v1/namespaces/default/pods", "{", http.StatusBadRequest, metav1.StatusReasonBadRequest},
+		{http.MethodPut, "/api/v1/namespaces/default/pods/a", "[]", http.StatusBadRequest, metav1.StatusReasonBadRequest},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := ta.do(context.Background(), req)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d %s", tc.method, tc.path, tc.code, w.Code, w.Body)
+			continue
+		}
+		if contentType := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("%s %s: expected a JSON Status, got the content type %q", tc.method, tc.path, contentType)
+		}
+		status := &metav1.Status{}
+		if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+			t.Fatalf("%s %s: %s %s", tc.method, tc.path, err, w.Body)
+		}
+		if status.Kind != "Status" || status.Reason != tc.reason || int(status.Code) != tc.code {
+			t.Errorf("%s %s: unexpected status %+v", tc.method, tc.path, status)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const maxPooledClients = 1024
+
+type pooledClient struct {
+	client   client.WithWatch
+	lastUsed time.Time
+}
+
+// clientPool keeps one impersonating client per identity so that transports are not rebuilt on every request.
+type clientPool struct {
+	config *rest.Config
+	scheme *runtime.Scheme
+	mapper meta.RESTMapper
+
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+}
+
+func newClientPool(config *rest.Config, scheme *runtime.Scheme, mapper meta.RESTMapper) *clientPool {
+	return &clientPool{config: config, scheme: scheme, mapper: mapper, clients: map[string]*pooledClient{}}
+}
+
+// clientFor returns a client sending Impersonate-User, Impersonate-Uid, Impersonate-Group and Impersonate-Extra for userInfo.
+func (p *clientPool) clientFor(userInfo *auth.UserInfo) (client.WithWatch, error) {
+	key := identityKey(userInfo)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pooled, ok := p.clients[key]; ok {
+		pooled.lastUsed = time.Now()
+		return pooled.client, nil
+	}
+
+	config := rest.CopyConfig(p.config)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: userInfo.Username,
+		UID:      userInfo.UID,
+		Groups:   userInfo.Groups,
+		Extra:    userInfo.Extra,
+	}
+	c, err := client.NewWithWatch(config, client.Options{Scheme: p.scheme, Mapper: p.mapper})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.clients) >= maxPooledClients {
+		p.evictOldest()
+	}
+	p.clients[key] = &pooledClient{client: c, lastUsed: time.Now()}
+	return c, nil
+}
+
+func (p *clientPool) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, pooled := range p.clients {
+		if oldestKey == "" || pooled.lastUsed.Before(oldest) {
+			oldestKey, oldest = key, pooled.lastUsed
+		}
+	}
+	delete(p.clients, oldestKey)
+}
+
+func identityKey(userInfo *auth.UserInfo) string {
+	b := &strings.Builder{}
+	b.WriteString(userInfo.Username)
+	b.WriteString("\x00u:")
+	b.WriteString(userInfo.UID)
+	for _, group := range userInfo.Groups {
+		b.WriteString("\x00g:")
+		b.WriteString(group)
+	}
+	keys := make([]string, 0, len(userInfo.Extra))
+	for k := range userInfo.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("\x00e:")
+		b.WriteString(k)
+		for _, v := range userInfo.Extra[k] {
+			b.WriteString("\x00")
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
@@ -1,51 +1,156 @@
 package api
 
 import (
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	toolscache "k8s.io/client-go/tools/cache"
 )
 
-type EventHandler struct {
-	Name      string
-	Namespace string
-	FirstTime bool
-	Sig       chan struct{}
+type WatchEvent struct {
+	Type   watch.EventType
+	Object *unstructured.Unstructured
+}
+
+// WatchEventHandler turns informer notifications of the objects matching its filters into watch events.
+type WatchEventHandler struct {
+	Name          string
+	Namespace     string
+	LabelSelector labels.Selector
+	// FieldSelector is evaluated against the fields of each object, indexed or not.
+	FieldSelector fields.Selector
+	// SkipInitialList ignores the objects already in the informer when the handler is registered.
+	SkipInitialList bool
+	// ResourceVersion resumes the watch after it, from the recent events the hub keeps,
+	// "" and "0" replay all of the initial list as ADDED events.
+	ResourceVersion string
+
+	queue *watchQueue
 }
 
-func (e *EventHandler) OnAdd(obj interface{}, isInInitialList bool) {
-	if !e.match(obj) {
+func (e *WatchEventHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	if isInInitialList && e.SkipInitialList {
 		return
 	}
-	if e.FirstTime {
-		e.Sig <- struct{}{}
-		e.FirstTime = false
+	e.send(e.added(obj))
+}
+
+func (e *WatchEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	e.send(e.updated(oldObj, newObj))
+}
+
+func (e *WatchEventHandler) OnDelete(obj interface{}) {
+	e.send(e.deleted(obj))
+}
+
+func (e *WatchEventHandler) added(obj interface{}) (WatchEvent, bool) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || !e.match(u) || !newerThan(u.GetResourceVersion(), e.ResourceVersion) {
+		return WatchEvent{}, false
 	}
-	if !isInInitialList {
-		e.Sig <- struct{}{}
+	return WatchEvent{Type: watch.Added, Object: u}, true
+}
+
+func (e *WatchEventHandler) updated(oldObj, newObj interface{}) (WatchEvent, bool) {
+	oldU, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return WatchEvent{}, false
 	}
+	newU, ok := newObj.(*unstructured.Unstructured)
+	// changes the informer had not delivered yet when a watch resumed from a later resourceVersion are skipped
+	if !ok || oldU.GetResourceVersion() == newU.GetResourceVersion() || !newerThan(newU.GetResourceVersion(), e.ResourceVersion) {
+		return WatchEvent{}, false
+	}
+	// objects entering or leaving the selection are added or deleted for this watcher
+	oldMatch, newMatch := e.match(oldU), e.match(newU)
+	switch {
+	case oldMatch && newMatch:
+		return WatchEvent{Type: watch.Modified, Object: newU}, true
+	case newMatch:
+		return WatchEvent{Type: watch.Added, Object: newU}, true
+	case oldMatch:
+		return WatchEvent{Type: watch.Deleted, Object: newU}, true
+	}
+	return WatchEvent{}, false
 }
 
-func (e *EventHandler) OnUpdate(oldObj, newObj interface{}) {
-	if !e.match(oldObj) {
-		return
+func (e *WatchEventHandler) deleted(obj interface{}) (WatchEvent, bool) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
 	}
-	if oldObj.(client.Object).GetResourceVersion() != newObj.(client.Object).GetResourceVersion() {
-		e.Sig <- struct{}{}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || !e.match(u) {
+		return WatchEvent{}, false
 	}
+	return WatchEvent{Type: watch.Deleted, Object: u}, true
 }
 
-func (e *EventHandler) OnDelete(obj interface{}) {
-	if !e.match(obj) {
-		return
+// replay queues the objects of the initial list matching the filters as ADDED events.
+func (e *WatchEventHandler) replay(objs []interface{}) {
+	var events []WatchEvent
+	for _, obj := range objs {
+		if event, ok := e.added(obj); ok {
+			events = append(events, event)
+		}
+	}
+	e.queue.pushInitial(events)
+}
+
+// resume queues the events a watch resuming from its resourceVersion missed, as they were notified.
+func (e *WatchEventHandler) resume(missed []windowEvent) {
+	var events []WatchEvent
+	for _, m := range missed {
+		var event WatchEvent
+		var ok bool
+		switch m.eventType {
+		case watch.Added:
+			event, ok = e.added(m.obj)
+		case watch.Modified:
+			event, ok = e.updated(m.oldObj, m.obj)
+		case watch.Deleted:
+			event, ok = e.deleted(m.obj)
+		}
+		if ok {
+			events = append(events, event)
+		}
+	}
+	e.queue.pushInitial(events)
+}
+
+func (e *WatchEventHandler) send(event WatchEvent, ok bool) {
+	if ok {
+		e.queue.push(event)
 	}
-	e.Sig <- struct{}{}
 }
 
-func (e *EventHandler) match(obj interface{}) bool {
-	if e.Name != "" && obj.(client.Object).GetName() != e.Name {
+func (e *WatchEventHandler) match(obj *unstructured.Unstructured) bool {
+	if e.Name != "" && obj.GetName() != e.Name {
 		return false
 	}
-	if e.Namespace != "" && obj.(client.Object).GetNamespace() != e.Namespace {
+	if e.Namespace != "" && obj.GetNamespace() != e.Namespace {
 		return false
 	}
-	return true
+	if e.LabelSelector != nil && !e.LabelSelector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	return matchFields(e.FieldSelector, obj)
+}
+
+// newerThan compares resource versions as the integers etcd uses, anything unparsable counts as newer.
+func newerThan(resourceVersion, than string) bool {
+	if than == "" || than == "0" {
+		return true
+	}
+	rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return true
+	}
+	thanRV, err := strconv.ParseUint(than, 10, 64)
+	if err != nil {
+		return true
+	}
+	return rv > thanRV
 }
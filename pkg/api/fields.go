@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// IndexFields registers a cache index per field of each kind, it has to be called before the cache starts.
+func IndexFields(ctx context.Context, indexer client.FieldIndexer, indexes map[runtimeschema.GroupVersionKind][]string) error {
+	for gvk, fieldPaths := range indexes {
+		for _, fieldPath := range fieldPaths {
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(gvk)
+			fieldPath := fieldPath
+			err := indexer.IndexField(ctx, obj, fieldPath, func(obj client.Object) []string {
+				value, ok := fieldValue(obj.(*unstructured.Unstructured), fieldPath)
+				if !ok {
+					return nil
+				}
+				return []string{value}
+			})
+			if err != nil {
+				return fmt.Errorf("index %s of %s: %w", fieldPath, gvk, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitFieldSelector splits selector into the exact matches on fields indexed for gvk, answered by the cache,
+// and the requirements left to matchFields. Either is nil when empty.
+func (a *Api) splitFieldSelector(gvk runtimeschema.GroupVersionKind, selector fields.Selector) (fields.Selector, fields.Selector) {
+	if selector == nil || selector.Empty() {
+		return nil, nil
+	}
+	var indexed, rest []fields.Selector
+	for _, requirement := range selector.Requirements() {
+		term := requirementSelector(requirement)
+		if requirement.Operator != selection.NotEquals && a.indexed(gvk, requirement.Field) {
+			indexed = append(indexed, term)
+		} else {
+			rest = append(rest, term)
+		}
+	}
+	return andSelectors(indexed), andSelectors(rest)
+}
+
+// splitGenericFieldSelector splits selector into the requirements on metadata.name and metadata.namespace,
+// which the apiserver supports for every kind, and the rest. Either is nil when empty.
+func splitGenericFieldSelector(selector fields.Selector) (fields.Selector, fields.Selector) {
+	var generic, rest []fields.Selector
+	for _, requirement := range selector.Requirements() {
+		term := requirementSelector(requirement)
+		if requirement.Field == "metadata.name" || requirement.Field == "metadata.namespace" {
+			generic = append(generic, term)
+		} else {
+			rest = append(rest, term)
+		}
+	}
+	return andSelectors(generic), andSelectors(rest)
+}
+
+func (a *Api) indexed(gvk runtimeschema.GroupVersionKind, fieldPath string) bool {
+	for _, indexed := range a.opts.FieldIndexes[gvk] {
+		if indexed == fieldPath {
+			return true
+		}
+	}
+	return false
+}
+
+func requirementSelector(requirement fields.Requirement) fields.Selector {
+	if requirement.Operator == selection.NotEquals {
+		return fields.OneTermNotEqualSelector(requirement.Field, requirement.Value)
+	}
+	return fields.OneTermEqualSelector(requirement.Field, requirement.Value)
+}
+
+func andSelectors(selectors []fields.Selector) fields.Selector {
+	if len(selectors) == 0 {
+		return nil
+	}
+	return fields.AndSelectors(selectors...)
+}
+
+// matchFields evaluates selector against the fields of obj, missing fields match as empty values.
+func matchFields(selector fields.Selector, obj *unstructured.Unstructured) bool {
+	if selector == nil || selector.Empty() {
+		return true
+	}
+	set := fields.Set{}
+	for _, requirement := range selector.Requirements() {
+		set[requirement.Field], _ = fieldValue(obj, requirement.Field)
+	}
+	return selector.Matches(set)
+}
+
+// fieldValue returns the value of a dotted field path such as spec.nodeName as a field selector compares it.
+func fieldValue(obj *unstructured.Unstructured, fieldPath string) (string, bool) {
+	value, ok, err := unstructured.NestedFieldNoCopy(obj.Object, strings.Split(fieldPath, ".")...)
+	if err != nil || !ok || value == nil {
+		return "", false
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(value), true
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	watchSubscribersDesc = prometheus.NewDesc(
+		"kube_apiserver_proxy_watch_subscribers",
+		"Number of watchers subscribed to the hub per resource kind.",
+		[]string{"group", "version", "kind"}, nil)
+	watchQueueDepthDesc = prometheus.NewDesc(
+		"kube_apiserver_proxy_watch_queue_depth",
+		"Number of events waiting in the queues of the watchers per resource kind.",
+		[]string{"group", "version", "kind"}, nil)
+	watchMaxQueueDepthDesc = prometheus.NewDesc(
+		"kube_apiserver_proxy_watch_max_queue_depth",
+		"Number of events waiting in the fullest watcher queue per resource kind.",
+		[]string{"group", "version", "kind"}, nil)
+)
+
+const defaultWatchWindowSize = 100
+
+// gvkWatch is the single informer handler of a kind, fanning its notifications out to the subscribers.
+// It keeps the latest of them, so watches resume from a recent resourceVersion like from the apiserver's watch cache.
+type gvkWatch struct {
+	gvk      runtimeschema.GroupVersionKind
+	informer cache.Informer
+
+	mu          sync.RWMutex
+	subscribers map[*WatchEventHandler]struct{}
+	// window holds the events after windowStart, at most windowSize of them
+	window      []windowEvent
+	windowSize  int
+	windowStart uint64
+}
+
+// windowEvent is a notification of the informer kept for the watches resuming from before it.
+type windowEvent struct {
+	resourceVersion uint64
+	eventType       watch.EventType
+	oldObj, obj     interface{}
+}
+
+func newGVKWatch(gvk runtimeschema.GroupVersionKind, informer cache.Informer, windowSize int) *gvkWatch {
+	w := &gvkWatch{gvk: gvk, informer: informer, subscribers: map[*WatchEventHandler]struct{}{}, windowSize: windowSize}
+	// the events before the handler is added are unknown, so is everything without the informer's resourceVersion
+	w.windowStart = math.MaxUint64
+	w.reset()
+	return w
+}
+
+// The initial list of the shared handler is ignored, subscribers get theirs replayed from the cache.
+func (w *gvkWatch) OnAdd(obj interface{}, isInInitialList bool) {
+	if isInInitialList {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.record(watch.Added, nil, obj)
+	for subscriber := range w.subscribers {
+		subscriber.OnAdd(obj, false)
+	}
+}
+
+func (w *gvkWatch) OnUpdate(oldObj, newObj interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.record(watch.Modified, oldObj, newObj)
+	for subscriber := range w.subscribers {
+		subscriber.OnUpdate(oldObj, newObj)
+	}
+}
+
+func (w *gvkWatch) OnDelete(obj interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		// the informer relisted, the deletion happened at some unknown version
+		w.reset()
+	} else {
+		w.record(watch.Deleted, nil, obj)
+	}
+	for subscriber := range w.subscribers {
+		subscriber.OnDelete(obj)
+	}
+}
+
+// record appends an event to the window, caller must hold the lock.
+func (w *gvkWatch) record(eventType watch.EventType, oldObj, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if oldU, ok := oldObj.(*unstructured.Unstructured); ok && oldU.GetResourceVersion() == u.GetResourceVersion() {
+		// resyncs change nothing
+		return
+	}
+	resourceVersion, err := strconv.ParseUint(u.GetResourceVersion(), 10, 64)
+	if err != nil || resourceVersion <= w.newest() {
+		// relists notify the differences to the state, not the events, so the window is no longer complete
+		w.reset()
+		return
+	}
+	w.window = append(w.window, windowEvent{resourceVersion: resourceVersion, eventType: eventType, oldObj: oldObj, obj: obj})
+	if len(w.window) > w.windowSize {
+		w.windowStart = w.window[0].resourceVersion
+		w.window = w.window[1:]
+	}
+}
+
+// reset empties the window, it starts at the latest resourceVersion seen, caller must hold the lock.
+func (w *gvkWatch) reset() {
+	start := w.newest()
+	if synced, ok := w.informer.(interface{ LastSyncResourceVersion() string }); ok {
+		if last, err := strconv.ParseUint(synced.LastSyncResourceVersion(), 10, 64); err == nil && (start == math.MaxUint64 || last > start) {
+			start = last
+		}
+	}
+	w.window, w.windowStart = nil, start
+}
+
+func (w *gvkWatch) newest() uint64 {
+	if len(w.window) == 0 {
+		return w.windowStart
+	}
+	return w.window[len(w.window)-1].resourceVersion
+}
+
+// since returns the events after resourceVersion. Like the apiserver once its watch cache moved past it, a version
+// older than the window is 410 Gone: the events in between, deletions included, could not be sent.
+// Caller must hold the lock.
+func (w *gvkWatch) since(resourceVersion string) ([]windowEvent, error) {
+	rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version %q", resourceVersion))
+	}
+	if rv < w.windowStart {
+		return nil, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", rv, w.windowStart))
+	}
+	i := sort.Search(len(w.window), func(i int) bool {
+		return w.window[i].resourceVersion > rv
+	})
+	return slices.Clone(w.window[i:]), nil
+}
+
+// watchHub keeps one informer handler per kind no matter how many clients watch it. The handler stays
+// as long as the informer, so does the window of its events between the watches.
+type watchHub struct {
+	cache      cache.Cache
+	windowSize int
+
+	mu      sync.Mutex
+	watches map[runtimeschema.GroupVersionKind]*gvkWatch
+}
+
+func newWatchHub(c cache.Cache, windowSize int) *watchHub {
+	return &watchHub{cache: c, windowSize: windowSize, watches: map[runtimeschema.GroupVersionKind]*gvkWatch{}}
+}
+
+// subscribe fans the events of gvk matching the filters of e out to its queue, after the objects already
+// in the cache unless e skips the initial list, or after the events since the resourceVersion of e.
+// The returned func unsubscribes e.
+func (h *watchHub) subscribe(ctx context.Context, gvk runtimeschema.GroupVersionKind, e *WatchEventHandler) (func(), error) {
+	informer, err := h.cache.GetInformerForKind(ctx, gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	w, ok := h.watches[gvk]
+	// an informer stopped while nobody watched was replaced, the handler went with it
+	if !ok || w.informer != informer {
+		w = newGVKWatch(gvk, informer, h.windowSize)
+		_, err = informer.AddEventHandler(w)
+		if err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+		h.watches[gvk] = w
+	}
+	h.mu.Unlock()
+
+	// the initial list or the missed events are taken along with the subscription, so no change falls in between,
+	// and queued by the watcher's goroutine ahead of the events fanned out meanwhile, without stalling the others
+	var initial []interface{}
+	var missed []windowEvent
+	w.mu.Lock()
+	switch {
+	case e.ResourceVersion != "" && e.ResourceVersion != "0":
+		missed, err = w.since(e.ResourceVersion)
+	case !e.SkipInitialList:
+		initial, err = h.snapshot(ctx, w, e.Namespace)
+	}
+	if err == nil {
+		w.subscribers[e] = struct{}{}
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	e.replay(initial)
+	e.resume(missed)
+
+	return func() {
+		w.mu.Lock()
+		delete(w.subscribers, e)
+		w.mu.Unlock()
+	}, nil
+}
+
+// snapshot returns the objects in the informer of w, without copying them when its store is at hand.
+func (h *watchHub) snapshot(ctx context.Context, w *gvkWatch, namespace string) ([]interface{}, error) {
+	if store, ok := w.informer.(interface{ GetStore() toolscache.Store }); ok {
+		return store.GetStore().List(), nil
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(w.gvk)
+	err := h.cache.List(ctx, list, client.InNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]interface{}, len(list.Items))
+	for i := range list.Items {
+		objs[i] = &list.Items[i]
+	}
+	return objs, nil
+}
+
+func (h *watchHub) Describe(ch chan<- *prometheus.Desc) {
+	ch <- watchSubscribersDesc
+	ch <- watchQueueDepthDesc
+	ch <- watchMaxQueueDepthDesc
+}
+
+func (h *watchHub) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	watches := make([]*gvkWatch, 0, len(h.watches))
+	for _, w := range h.watches {
+		watches = append(watches, w)
+	}
+	h.mu.Unlock()
+
+	for _, w := range watches {
+		w.mu.RLock()
+		subscribers, depth, maxDepth := len(w.subscribers), 0, 0
+		for subscriber := range w.subscribers {
+			d := subscriber.queue.len()
+			depth += d
+			maxDepth = max(maxDepth, d)
+		}
+		w.mu.RUnlock()
+
+		labels := []string{w.gvk.Group, w.gvk.Version, w.gvk.Kind}
+		ch <- prometheus.MustNewConstMetric(watchSubscribersDesc, prometheus.GaugeValue, float64(subscribers), labels...)
+		ch <- prometheus.MustNewConstMetric(watchQueueDepthDesc, prometheus.GaugeValue, float64(depth), labels...)
+		ch <- prometheus.MustNewConstMetric(watchMaxQueueDepthDesc, prometheus.GaugeValue, float64(maxDepth), labels...)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllertest"
+)
+
+// syncedInformer is a fake informer that last saw resourceVersion.
+type syncedInformer struct {
+	*controllertest.FakeInformer
+	resourceVersion string
+}
+
+func (i *syncedInformer) LastSyncResourceVersion() string {
+	return i.resourceVersion
+}
+
+func versionedPod(name, resourceVersion string) *unstructured.Unstructured {
+	obj := queuedEvent(watch.Added, name).Object
+	obj.SetNamespace("default")
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+// newWindowTestHub returns a hub with a window of windowSize events over an informer synced at resourceVersion 100.
+func newWindowTestHub(t *testing.T, windowSize int) (*watchHub, *syncedInformer) {
+	informer := &syncedInformer{FakeInformer: &controllertest.FakeInformer{}, resourceVersion: "100"}
+	informers := &informertest.FakeInformers{InformersByGVK: map[runtimeschema.GroupVersionKind]toolscache.SharedIndexInformer{podGVK: informer}}
+	h := newWatchHub(&testCache{FakeInformers: informers}, windowSize)
+	// the first watch adds the handler of the kind, it is kept after the watch ends
+	stop, err := h.subscribe(context.Background(), podGVK, &WatchEventHandler{SkipInitialList: true, queue: newWatchQueue(10, BackpressureDisconnect)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	return h, informer
+}
+
+// resume watches from resourceVersion, returning the events replayed.
+func resume(t *testing.T, h *watchHub, resourceVersion string) ([]WatchEvent, error) {
+	e := &WatchEventHandler{ResourceVersion: resourceVersion, queue: newWatchQueue(10, BackpressureDisconnect)}
+	stop, err := h.subscribe(context.Background(), podGVK, e)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	events, _ := e.queue.pop()
+	return events, nil
+}
+
+func TestWatchResume(t *testing.T) {
+	h, informer := newWindowTestHub(t, 3)
+	informer.Add(versionedPod("a", "101"))
+	informer.Update(versionedPod("a", "101"), versionedPod("a", "102"))
+	informer.Delete(versionedPod("b", "103"))
+	informer.Add(versionedPod("c", "104"))
+
+	for _, tc := range []struct {
+		resourceVersion string
+		expected        []string
+	}{
+		{"101", []string{"MODIFIED a 102", "DELETED b 103", "ADDED c 104"}},
+		{"103", []string{"ADDED c 104"}},
+		{"104", nil},
+		{"105", nil},
+	} {
+		events, err := resume(t, h, tc.resourceVersion)
+		if err != nil {
+			t.Errorf("resuming from %s: %v", tc.resourceVersion, err)
+			continue
+		}
+		var got []string
+		for _, event := range events {
+			got = append(got, string(event.Type)+" "+event.Object.GetName()+" "+event.Object.GetResourceVersion())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("resuming from %s replayed %v, expected %v", tc.resourceVersion, got, tc.expected)
+		}
+	}
+
+	// 101 itself left the window, the watch could miss its change
+	for _, resourceVersion := range []string{"100", "1"} {
+		if _, err := resume(t, h, resourceVersion); !apierrors.IsResourceExpired(err) {
+			t.Errorf("expected resuming from %s to be gone, got %v", resourceVersion, err)
+		}
+	}
+	if _, err := resume(t, h, "abc"); !apierrors.IsBadRequest(err) {
+		t.Errorf("expected an invalid resourceVersion to be rejected, got %v", err)
+	}
+}
+
+func TestWatchResumeAfterRelist(t *testing.T) {
+	h, informer := newWindowTestHub(t, 10)
+	informer.Add(versionedPod("a", "101"))
+	informer.Add(versionedPod("b", "102"))
+	// a relist deletes the objects gone meanwhile at an unknown version
+	informer.resourceVersion = "110"
+	h.watches[podGVK].OnDelete(toolscache.DeletedFinalStateUnknown{Key: "default/a", Obj: versionedPod("a", "101")})
+
+	if _, err := resume(t, h, "102"); !apierrors.IsResourceExpired(err) {
+		t.Errorf("expected resuming from before the relist to be gone, got %v", err)
+	}
+	if events, err := resume(t, h, "110"); err != nil || len(events) != 0 {
+		t.Errorf("unexpected resume from the relist: %v, %v", events, err)
+	}
+}
+
+func TestWatchFromResourceVersion(t *testing.T) {
+	e := &WatchEventHandler{ResourceVersion: "100", queue: newWatchQueue(10, BackpressureDisconnect)}
+	obj := func(name, resourceVersion string) interface{} {
+		return versionedPod(name, resourceVersion)
+	}
+
+	// changes up to the resourceVersion the watch resumes from were already seen by the watcher
+	e.OnAdd(obj("a", "90"), false)
+	e.OnUpdate(obj("a", "90"), obj("a", "100"))
+	e.OnAdd(obj("b", "101"), false)
+	e.OnUpdate(obj("a", "100"), obj("a", "102"))
+
+	events, _ := e.queue.pop()
+	if len(events) != 2 || events[0].Object.GetName() != "b" || events[1].Object.GetResourceVersion() != "102" {
+		t.Errorf("unexpected events %v", events)
+	}
+}
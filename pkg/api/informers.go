@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// trackedInformer is an informer of the cache started for the reads and watches of users.
+type trackedInformer struct {
+	refs       int
+	pinned     bool
+	lastAccess time.Time
+}
+
+// informerTracker counts the watches on each informer of the cache and stops the informers
+// neither watched nor read for idleTTL, so memory does not grow with every kind ever requested.
+type informerTracker struct {
+	cache   cache.Cache
+	idleTTL time.Duration
+
+	mu        sync.Mutex
+	informers map[runtimeschema.GroupVersionKind]*trackedInformer
+}
+
+// newInformerTracker pins the informers of the pinned kinds, their field indexes would be lost with them.
+func newInformerTracker(c cache.Cache, idleTTL time.Duration, pinned []runtimeschema.GroupVersionKind) *informerTracker {
+	t := &informerTracker{cache: c, idleTTL: idleTTL, informers: map[runtimeschema.GroupVersionKind]*trackedInformer{}}
+	now := time.Now()
+	for _, gvk := range pinned {
+		t.informers[gvk] = &trackedInformer{pinned: true, lastAccess: now}
+	}
+	return t
+}
+
+func (t *informerTracker) get(gvk runtimeschema.GroupVersionKind) *trackedInformer {
+	informer, ok := t.informers[gvk]
+	if !ok {
+		informer = &trackedInformer{}
+		t.informers[gvk] = informer
+	}
+	informer.lastAccess = time.Now()
+	return informer
+}
+
+// touch records a cached read of gvk.
+func (t *informerTracker) touch(gvk runtimeschema.GroupVersionKind) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(gvk)
+}
+
+// acquire keeps the informer of gvk running until release is called.
+func (t *informerTracker) acquire(gvk runtimeschema.GroupVersionKind) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(gvk).refs++
+}
+
+func (t *informerTracker) release(gvk runtimeschema.GroupVersionKind) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(gvk).refs--
+}
+
+// run evicts idle informers until ctx is done, a zero idleTTL keeps them forever.
+func (t *informerTracker) run(ctx context.Context) {
+	if t.idleTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.idleTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.evict(ctx, now)
+		}
+	}
+}
+
+func (t *informerTracker) evict(ctx context.Context, now time.Time) {
+	// the lock is held while stopping, so no watch can start on an informer being stopped
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for gvk, informer := range t.informers {
+		if informer.pinned || informer.refs > 0 || now.Sub(informer.lastAccess) < t.idleTTL {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		if err := t.cache.RemoveInformer(ctx, obj); err != nil {
+			fmt.Printf("remove informer of %s error: %s\n", gvk, err)
+			continue
+		}
+		delete(t.informers, gvk)
+		fmt.Printf("informer of %s removed after %s idle\n", gvk, now.Sub(informer.lastAccess))
+	}
+}
+
+func (t *informerTracker) list(ctx context.Context) []http_common.InformerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]http_common.InformerInfo, 0, len(t.informers))
+	for gvk, informer := range t.informers {
+		info := http_common.InformerInfo{
+			Group:      gvk.Group,
+			Version:    gvk.Version,
+			Kind:       gvk.Kind,
+			Watchers:   informer.refs,
+			Pinned:     informer.pinned,
+			LastAccess: informer.lastAccess,
+		}
+		// the informer already exists, getting it does not start a new one
+		i, err := t.cache.GetInformerForKind(ctx, gvk, cache.BlockUntilSynced(false))
+		if err == nil {
+			if store, ok := i.(interface{ GetStore() toolscache.Store }); ok {
+				for _, obj := range store.GetStore().List() {
+					info.Objects++
+					if u, ok := obj.(*unstructured.Unstructured); ok {
+						info.EstimatedBytes += estimateSize(u.Object)
+					}
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Group+"/"+infos[i].Kind+"/"+infos[i].Version < infos[j].Group+"/"+infos[j].Kind+"/"+infos[j].Version
+	})
+	return infos
+}
+
+// estimateSize roughly estimates the memory an unstructured value takes: string contents,
+// plus the headers of strings, interfaces, maps and slices.
+func estimateSize(value interface{}) int64 {
+	const header = 16
+	switch v := value.(type) {
+	case map[string]interface{}:
+		size := int64(48)
+		for key, item := range v {
+			size += header + int64(len(key)) + header + estimateSize(item)
+		}
+		return size
+	case []interface{}:
+		size := int64(24)
+		for _, item := range v {
+			size += header + estimateSize(item)
+		}
+		return size
+	case string:
+		return int64(len(v))
+	default:
+		return 8
+	}
+}
+
+// Informers lists the informers started for users, their object counts, memory estimates and last access.
+func (a *Api) Informers(c *gin.Context) {
+	c.JSON(http.StatusOK, &http_common.InformerListResponse{Items: a.informers.list(c.Request.Context())})
+}
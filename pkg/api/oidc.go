@@ -0,0 +1,223 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authenticator"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/user"
+	"golang.org/x/oauth2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// oidcStateTTL is how long a user has to log in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// oidcStateCookie binds a login to the browser that started it.
+	oidcStateCookie = "oidc_state"
+	// oidcUserPrefix starts the names of the users of the provider.
+	oidcUserPrefix = "oidc-"
+)
+
+// OIDCOptions configure logging in through an OpenID provider with the authorization code flow and PKCE.
+type OIDCOptions struct {
+	// Provider verifies the ID tokens and maps their claims to the user name and groups.
+	Provider     *authenticator.OIDC
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the Callback handler as the browser reaches it.
+	RedirectURL string
+	Scopes      []string
+	// Namespace is the home namespace of the provider users.
+	Namespace string
+}
+
+type oidcState struct {
+	verifier string
+	nonce    string
+	expire   time.Time
+}
+
+type oidcLogin struct {
+	opts OIDCOptions
+
+	mu     sync.Mutex
+	states map[string]*oidcState
+}
+
+func newOIDCLogin(opts OIDCOptions) *oidcLogin {
+	if opts.Namespace == "" {
+		opts.Namespace = user.DefaultNamespace
+	}
+	return &oidcLogin{opts: opts, states: map[string]*oidcState{}}
+}
+
+func (o *oidcLogin) config(c *gin.Context) (*oauth2.Config, error) {
+	metadata, err := o.opts.Provider.Metadata(c.Request.Context())
+	if err != nil {
+		return nil, apierrors.NewServiceUnavailable(fmt.Sprintf("openid provider: %v", err))
+	}
+	return &oauth2.Config{
+		ClientID:     o.opts.ClientID,
+		ClientSecret: o.opts.ClientSecret,
+		RedirectURL:  o.opts.RedirectURL,
+		Scopes:       o.opts.Scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: metadata.AuthorizationEndpoint, TokenURL: metadata.TokenEndpoint},
+	}, nil
+}
+
+// saveState remembers the PKCE verifier and nonce of a login, dropping the logins never completed.
+func (o *oidcLogin) saveState(state string, s *oidcState) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for key, old := range o.states {
+		if old.expire.Before(now) {
+			delete(o.states, key)
+		}
+	}
+	o.states[state] = s
+}
+
+// takeState returns the login of state once.
+func (o *oidcLogin) takeState(state string) (*oidcState, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s, ok := o.states[state]
+	delete(o.states, state)
+	if !ok || s.expire.Before(time.Now()) {
+		return nil, false
+	}
+	return s, true
+}
+
+// OIDCLogin redirects to the provider, the login completes in OIDCCallback.
+func (a *Api) OIDCLogin(c *gin.Context) {
+	if a.oidc == nil {
+		http_common.Error(c, apierrors.NewNotFound(schema.GroupResource{}, "oidc"))
+		return
+	}
+	config, err := a.oidc.config(c)
+	if err != nil {
+		http_common.Error(c, err)
+		return
+	}
+	state, verifier, nonce := randomString(), randomString(), randomString()
+	a.oidc.saveState(state, &oidcState{verifier: verifier, nonce: nonce, expire: time.Now().Add(oidcStateTTL)})
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/user/oidc/", "", c.Request.TLS != nil, true)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	c.Redirect(http.StatusFound, config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", nonce)))
+}
+
+// OIDCCallback exchanges the authorization code, maps the claims of the ID token to a proxy user
+// and logs it in to its ServiceAccount, responding like Login.
+func (a *Api) OIDCCallback(c *gin.Context) {
+	if a.oidc == nil {
+		http_common.Error(c, apierrors.NewNotFound(schema.GroupResource{}, "oidc"))
+		return
+	}
+	u, err := a.oidcUser(c)
+	if err != nil {
+		http_common.Error(c, err)
+		return
+	}
+	a.loginServiceAccount(c, u)
+}
+
+// oidcUser completes the login of the callback request and returns the user it saved.
+func (a *Api) oidcUser(c *gin.Context) (*user.User, error) {
+	if e := c.Query("error"); e != "" {
+		return nil, apierrors.NewUnauthorized(fmt.Sprintf("openid provider: %s: %s", e, c.Query("error_description")))
+	}
+	// the state must come back to the browser it was issued to, or anyone could log a victim in as themselves
+	cookie, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/user/oidc/", "", c.Request.TLS != nil, true)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(c.Query("state"))) != 1 {
+		return nil, apierrors.NewBadRequest("the login state does not match the browser")
+	}
+	state, ok := a.oidc.takeState(c.Query("state"))
+	if !ok {
+		return nil, apierrors.NewBadRequest("unknown or expired login state")
+	}
+	config, err := a.oidc.config(c)
+	if err != nil {
+		return nil, err
+	}
+	token, err := config.Exchange(c.Request.Context(), c.Query("code"), oauth2.SetAuthURLParam("code_verifier", state.verifier))
+	if err != nil {
+		return nil, apierrors.NewUnauthorized(fmt.Sprintf("exchange authorization code: %v", err))
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, apierrors.NewUnauthorized("the openid provider returned no id token")
+	}
+	claims, err := a.oidc.opts.Provider.VerifyIDToken(c.Request.Context(), rawIDToken)
+	if err != nil {
+		return nil, apierrors.NewUnauthorized(fmt.Sprintf("invalid id token: %v", err))
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.nonce {
+		return nil, apierrors.NewUnauthorized("id token nonce does not match the login")
+	}
+
+	u, err := a.oidc.user(claims)
+	if err != nil {
+		return nil, apierrors.NewUnauthorized(err.Error())
+	}
+	u, err = a.users.Upsert(c.Request.Context(), u)
+	if errors.Is(err, user.ErrAlreadyExists) {
+		return nil, apierrors.NewUnauthorized(err.Error())
+	}
+	if err != nil {
+		fmt.Printf("save oidc user error: %s\n", err)
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, apierrors.NewUnauthorized(user.ErrDisabled.Error())
+	}
+	return u, nil
+}
+
+// user maps the claims of an ID token to a proxy user. Its name is a hash of the issuer and subject,
+// which identify the account at the provider for good, unlike the username claim.
+func (o *oidcLogin) user(claims map[string]interface{}) (*user.User, error) {
+	info, err := o.opts.Provider.Identity(claims)
+	if err != nil {
+		return nil, err
+	}
+	issuer, _ := claims["iss"].(string)
+	if issuer == "" || info.UID == "" {
+		return nil, errors.New("id token has no iss or sub claim")
+	}
+	sum := sha256.Sum256([]byte(issuer + "\x00" + info.UID))
+	return &user.User{
+		Name:      oidcUserPrefix + hex.EncodeToString(sum[:20]),
+		Namespace: o.opts.Namespace,
+		Groups:    info.Groups,
+		Issuer:    issuer,
+		Subject:   info.UID,
+	}, nil
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
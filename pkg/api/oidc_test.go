@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authenticator"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/user"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// mockIdP is an OpenID provider issuing the ID token of the next login for any authorization code,
+// as long as the PKCE verifier matches the challenge of the login.
+type mockIdP struct {
+	*httptest.Server
+	signer jose.Signer
+
+	mu        sync.Mutex
+	claims    map[string]interface{}
+	challenge string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{signer: signer}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&authenticator.ProviderMetadata{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		claims, challenge := idp.claims, idp.challenge
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		idToken, err := jwt.Signed(idp.signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// login starts a login at the proxy and lets the provider authenticate the account of claims,
+// returning the callback request the browser would send.
+func (idp *mockIdP) login(t *testing.T, a *Api, claims map[string]interface{}) *http.Request {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/user/oidc/login", nil)
+	a.OIDCLogin(c)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login responded %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("login did not use PKCE: %s", location)
+	}
+
+	idTokenClaims := map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   "proxy",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		idTokenClaims[k] = v
+	}
+	idp.mu.Lock()
+	idp.claims, idp.challenge = idTokenClaims, query.Get("code_challenge")
+	idp.mu.Unlock()
+
+	callback := httptest.NewRequest(http.MethodGet, "/user/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	for _, cookie := range w.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	return callback
+}
+
+func newOIDCTestApi(t *testing.T, idp *mockIdP) *Api {
+	users, err := user.NewFileStore(filepath.Join(t.TempDir(), "users.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := authenticator.NewOIDC(authenticator.NewKeySet(idp.Client(), idp.URL), idp.URL, "proxy", authenticator.OIDCClaims{GroupsClaim: "groups", GroupsPrefix: "oidc:"})
+	return &Api{users: users, oidc: newOIDCLogin(OIDCOptions{Provider: provider, ClientID: "proxy", RedirectURL: "http://proxy/user/oidc/callback", Scopes: []string{"openid"}})}
+}
+
+func callback(a *Api, req *http.Request) (*user.User, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return a.oidcUser(c)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	idp := newMockIdP(t)
+	a := newOIDCTestApi(t, idp)
+
+	u, err := callback(a, idp.login(t, a, map[string]interface{}{"sub": "1", "email": "a+b@example.com", "groups": []string{"dev"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Name, oidcUserPrefix) || u.Issuer != idp.URL || u.Subject != "1" || u.PasswordHash != "" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if len(u.Groups) != 1 || u.Groups[0] != "oidc:dev" {
+		t.Errorf("unexpected groups %v", u.Groups)
+	}
+
+	// the same account logs in as the same user whatever its email, others never do
+	again, err := callback(a, idp.login(t, a, map[string]interface{}{"sub": "1", "email": "renamed@example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Name != u.Name {
+		t.Errorf("account 1 logged in as %s and %s", u.Name, again.Name)
+	}
+	other, err := callback(a, idp.login(t, a, map[string]interface{}{"sub": "2", "email": "a-b@example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Name == u.Name {
+		t.Errorf("accounts 1 and 2 share the user %s", u.Name)
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	idp := newMockIdP(t)
+	a := newOIDCTestApi(t, idp)
+	claims := map[string]interface{}{"sub": "1", "email": "a@example.com"}
+
+	t.Run("state of another browser", func(t *testing.T) {
+		req := idp.login(t, a, claims)
+		req.Header.Del("Cookie")
+		_, err := callback(a, req)
+		if !apierrors.IsBadRequest(err) {
+			t.Errorf("expected a bad request, got %v", err)
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		_, err := callback(a, idp.login(t, a, map[string]interface{}{"sub": "1", "email": "a@example.com", "email_verified": false}))
+		if !apierrors.IsUnauthorized(err) {
+			t.Errorf("expected unauthorized, got %v", err)
+		}
+	})
+
+	t.Run("password user of the same name", func(t *testing.T) {
+		expected, err := a.oidc.user(map[string]interface{}{"iss": idp.URL, "sub": "1", "email": "a@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.users.Create(context.Background(), &user.User{Name: expected.Name}, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = callback(a, idp.login(t, a, claims))
+		if !apierrors.IsUnauthorized(err) {
+			t.Errorf("expected unauthorized, got %v", err)
+		}
+		u, err := a.users.Verify(context.Background(), expected.Name, "password")
+		if err != nil || u.Subject != "" {
+			t.Errorf("the password user was replaced: %+v, %v", u, err)
+		}
+	})
+
+	t.Run("state used twice", func(t *testing.T) {
+		req := idp.login(t, a, map[string]interface{}{"sub": "3", "email": "c@example.com"})
+		if _, err := callback(a, req); err != nil {
+			t.Fatal(err)
+		}
+		_, err := callback(a, req)
+		if !apierrors.IsBadRequest(err) {
+			t.Errorf("expected a bad request, got %v", err)
+		}
+	})
+}
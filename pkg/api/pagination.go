@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// cacheContinueVersion tells the continue tokens of the proxy apart from those of the apiserver,
+// whose version is meta.k8s.io/v1.
+const cacheContinueVersion = "cache.kube-apiserver-proxy/v1"
+
+// cacheContinue is the opaque continue token of a cached list, items are ordered by namespace and name
+// and the next page starts at Start.
+type cacheContinue struct {
+	Version string `json:"v"`
+	Start   string `json:"start"`
+}
+
+func encodeCacheContinue(start string) (string, error) {
+	data, err := json.Marshal(&cacheContinue{Version: cacheContinueVersion, Start: start})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCacheContinue(token string) (*cacheContinue, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false
+	}
+	c := &cacheContinue{}
+	if err = json.Unmarshal(data, c); err != nil || c.Version != cacheContinueVersion {
+		return nil, false
+	}
+	return c, true
+}
+
+func isCacheContinue(token string) bool {
+	_, ok := decodeCacheContinue(token)
+	return ok
+}
+
+func itemKey(obj *unstructured.Unstructured) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// paginate cuts the page of limit items starting at the continue token out of a full list,
+// setting the continue token and remainingItemCount of the next page if any. A limit of 0 keeps all items.
+func paginate(objList *unstructured.UnstructuredList, limit int64, token string) error {
+	items := objList.Items
+	sort.Slice(items, func(i, j int) bool {
+		return itemKey(&items[i]) < itemKey(&items[j])
+	})
+
+	if token != "" {
+		c, ok := decodeCacheContinue(token)
+		if !ok {
+			return apierrors.NewBadRequest(fmt.Sprintf("invalid continue token %q", token))
+		}
+		start := sort.Search(len(items), func(i int) bool {
+			return itemKey(&items[i]) >= c.Start
+		})
+		items = items[start:]
+	}
+
+	objList.SetContinue("")
+	objList.SetRemainingItemCount(nil)
+	if limit > 0 && int64(len(items)) > limit {
+		next, err := encodeCacheContinue(itemKey(&items[limit]))
+		if err != nil {
+			return err
+		}
+		remaining := int64(len(items)) - limit
+		objList.SetContinue(next)
+		objList.SetRemainingItemCount(&remaining)
+		items = items[:limit]
+	}
+	objList.Items = items
+	return nil
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+)
+
+// reverseProxy forwards requests to the apiserver with the proxy's own credentials.
+// Upgrade requests (exec, attach, port-forward) go through a transport restricted to HTTP/1.1,
+// since connections cannot be upgraded over HTTP/2.
+type reverseProxy struct {
+	proxy        *httputil.ReverseProxy
+	upgradeProxy *httputil.ReverseProxy
+}
+
+func newReverseProxy(config *rest.Config) (*reverseProxy, error) {
+	target, _, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+	upgradeConfig := rest.CopyConfig(config)
+	upgradeConfig.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	upgradeTransport, err := rest.TransportFor(upgradeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	newProxy := func(transport http.RoundTripper) *httputil.ReverseProxy {
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+			},
+			Transport:     transport,
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				fmt.Printf("proxy %s error: %s\n", r.URL.Path, err)
+				http_common.WriteError(w, apierrors.NewServiceUnavailable(fmt.Sprintf("error trying to reach the apiserver: %s", err)))
+			},
+		}
+	}
+	return &reverseProxy{proxy: newProxy(transport), upgradeProxy: newProxy(upgradeTransport)}, nil
+}
+
+// Proxy forwards any authenticated and authorized request without a dedicated route to the apiserver,
+// e.g. subresources, discovery and aggregated APIs.
+func (a *Api) Proxy(c *gin.Context) {
+	req := c.Request
+	req.Header.Del("Authorization")
+	for name := range req.Header {
+		if strings.HasPrefix(name, "Impersonate-") {
+			req.Header.Del(name)
+		}
+	}
+	if a.clients != nil {
+		userInfo := c.MustGet(auth.ContextKey).(*auth.UserInfo)
+		req.Header.Set("Impersonate-User", userInfo.Username)
+		if userInfo.UID != "" {
+			req.Header.Set("Impersonate-Uid", userInfo.UID)
+		}
+		for _, group := range userInfo.Groups {
+			req.Header.Add("Impersonate-Group", group)
+		}
+		for k, values := range userInfo.Extra {
+			for _, v := range values {
+				req.Header.Add("Impersonate-Extra-"+url.PathEscape(k), v)
+			}
+		}
+	}
+
+	if httpstream.IsUpgradeRequest(req) {
+		a.proxy.upgradeProxy.ServeHTTP(c.Writer, req)
+		return
+	}
+	a.proxy.proxy.ServeHTTP(c.Writer, req)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const defaultWatchQueueSize = 1000
+
+var watchDroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kube_apiserver_proxy_watch_dropped_events_total",
+	Help: "Number of events dropped for watchers whose queue was full.",
+})
+
+// BackpressurePolicy decides what happens to events for a watcher whose queue is full.
+type BackpressurePolicy string
+
+const (
+	// BackpressureDrop drops new events while the queue is full.
+	BackpressureDrop BackpressurePolicy = "drop"
+	// BackpressureCoalesce merges queued events of the same object, the watcher is disconnected
+	// if the queue is still full of distinct objects.
+	BackpressureCoalesce BackpressurePolicy = "coalesce"
+	// BackpressureDisconnect disconnects the watcher as soon as its queue is full.
+	BackpressureDisconnect BackpressurePolicy = "disconnect"
+)
+
+func ParseBackpressurePolicy(policy string) (BackpressurePolicy, error) {
+	switch p := BackpressurePolicy(policy); p {
+	case BackpressureDrop, BackpressureCoalesce, BackpressureDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown backpressure policy %q", policy)
+	}
+}
+
+// watchQueue is the bounded queue between the informer handler and the goroutine streaming to a watcher.
+// push never blocks the informer, the stream is woken through notify.
+type watchQueue struct {
+	capacity int
+	policy   BackpressurePolicy
+
+	mu sync.Mutex
+	// initial is the initial list or the missed events, queued ahead of the events and never counted against the capacity
+	initial    []WatchEvent
+	events     []WatchEvent
+	overflowed bool
+	// closed is set once no more events come, the queued ones are still popped
+	closed bool
+
+	notify chan struct{}
+}
+
+func newWatchQueue(capacity int, policy BackpressurePolicy) *watchQueue {
+	return &watchQueue{
+		capacity: capacity,
+		policy:   policy,
+		events:   make([]WatchEvent, 0, capacity),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func (q *watchQueue) push(event WatchEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.overflowed {
+		return
+	}
+
+	if q.policy == BackpressureCoalesce && q.coalesce(event) {
+		q.wake()
+		return
+	}
+	if len(q.events) >= q.capacity {
+		if q.policy == BackpressureDrop {
+			watchDroppedEvents.Inc()
+			return
+		}
+		q.overflowed = true
+		q.initial, q.events = nil, q.events[:0]
+		q.wake()
+		return
+	}
+	q.events = append(q.events, event)
+	q.wake()
+}
+
+// pushInitial queues the initial list, or the events a resumed watch missed, ahead of the events pushed meanwhile,
+// however long it is.
+func (q *watchQueue) pushInitial(events []WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.overflowed {
+		return
+	}
+	q.initial = events
+	q.wake()
+}
+
+// coalesce merges event into an already queued event of the same object, caller must hold the lock.
+func (q *watchQueue) coalesce(event WatchEvent) bool {
+	var merged bool
+	q.events, merged = mergeEvent(q.events, event)
+	return merged
+}
+
+// mergeEvent merges event into the event of the same object in events, if there is one,
+// so that a watcher receiving the merged events ends up with the same state.
+func mergeEvent(events []WatchEvent, event WatchEvent) ([]WatchEvent, bool) {
+	for i := range events {
+		queued := &events[i]
+		if queued.Object.GetNamespace() != event.Object.GetNamespace() || queued.Object.GetName() != event.Object.GetName() {
+			continue
+		}
+		switch {
+		case queued.Type == watch.Added && event.Type == watch.Deleted:
+			// the watcher never saw the object
+			events = append(events[:i], events[i+1:]...)
+		case queued.Type == watch.Added:
+			queued.Object = event.Object
+		case queued.Type == watch.Deleted && event.Type == watch.Added:
+			queued.Type, queued.Object = watch.Modified, event.Object
+		default:
+			queued.Type, queued.Object = event.Type, event.Object
+		}
+		return events, true
+	}
+	return events, false
+}
+
+// coalesceEvents merges the events of the same object, keeping the order of their first occurrence.
+func coalesceEvents(events []WatchEvent) []WatchEvent {
+	coalesced := make([]WatchEvent, 0, len(events))
+	for _, event := range events {
+		var merged bool
+		if coalesced, merged = mergeEvent(coalesced, event); !merged {
+			coalesced = append(coalesced, event)
+		}
+	}
+	return coalesced
+}
+
+func (q *watchQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *watchQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.initial) + len(q.events)
+}
+
+// close ends the events after the queued ones.
+func (q *watchQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.wake()
+}
+
+// pop takes every queued event. An error tells that the watcher has to be disconnected: errWatcherTooSlow
+// once the queue overflowed, errWatchClosed once the queue was closed and emptied.
+func (q *watchQueue) pop() ([]WatchEvent, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := q.events
+	if len(q.initial) > 0 {
+		events, q.initial = append(q.initial, events...), nil
+	}
+	q.events = make([]WatchEvent, 0, q.capacity)
+	switch {
+	case q.overflowed:
+		return events, errWatcherTooSlow
+	case q.closed:
+		return events, errWatchClosed
+	}
+	return events, nil
+}
+
+func init() {
+	metrics.Registry.MustRegister(watchDroppedEvents)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func queuedEvent(eventType watch.EventType, name string) WatchEvent {
+	obj := &unstructured.Unstructured{}
+	obj.SetName(name)
+	return WatchEvent{Type: eventType, Object: obj}
+}
+
+func TestWatchQueueClose(t *testing.T) {
+	q := newWatchQueue(2, BackpressureDisconnect)
+	q.push(queuedEvent(watch.Added, "a"))
+	q.close()
+
+	// the events queued before closing are still delivered along with the end of the watch
+	events, err := q.pop()
+	if len(events) != 1 || events[0].Object.GetName() != "a" {
+		t.Errorf("unexpected events %v", events)
+	}
+	if err != errWatchClosed {
+		t.Errorf("expected the watch to be closed, got %v", err)
+	}
+}
+
+func TestWatchQueueOverflow(t *testing.T) {
+	q := newWatchQueue(1, BackpressureDisconnect)
+	q.pushInitial([]WatchEvent{queuedEvent(watch.Added, "a"), queuedEvent(watch.Added, "b")})
+	q.push(queuedEvent(watch.Added, "c"))
+	q.push(queuedEvent(watch.Added, "d"))
+	q.close()
+
+	// overflowing drops everything queued and wins over closing
+	events, err := q.pop()
+	if len(events) != 0 {
+		t.Errorf("unexpected events %v", events)
+	}
+	if err != errWatcherTooSlow {
+		t.Errorf("expected the watcher to be too slow, got %v", err)
+	}
+}
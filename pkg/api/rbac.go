@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rbacChanges broadcasts changes of RBAC objects, so open watches re-evaluate their authorization.
+type rbacChanges struct {
+	authz authorizer.Authorizer
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func newRBACChanges(ctx context.Context, c cache.Cache, authz authorizer.Authorizer) (*rbacChanges, error) {
+	r := &rbacChanges{authz: authz, changed: make(chan struct{})}
+	handler := toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				r.broadcast()
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) { r.broadcast() },
+		DeleteFunc: func(obj interface{}) { r.broadcast() },
+	}
+	for _, obj := range []client.Object{&rbacv1.RoleBinding{}, &rbacv1.ClusterRoleBinding{}, &rbacv1.Role{}, &rbacv1.ClusterRole{}} {
+		informer, err := c.GetInformer(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// changes returns a channel closed on the next RBAC change.
+func (r *rbacChanges) changes() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.changed
+}
+
+func (r *rbacChanges) broadcast() {
+	// cached decisions would keep revoked watches open until they expire
+	if invalidator, ok := r.authz.(authorizer.Invalidator); ok {
+		invalidator.Invalidate()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// reauthorize evaluates the attributes the Auth middleware authorized the request with again,
+// returning the error to end the stream with once access is revoked.
+func (a *Api) reauthorize(c *gin.Context) error {
+	value, ok := c.Get(authorizer.ContextKey)
+	if !ok {
+		return nil
+	}
+	attrs := value.(*authorizer.Attributes)
+	allowed, err := a.authz.Authorize(c.Request.Context(), attrs)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	if !allowed {
+		return authorizer.Forbidden(attrs)
+	}
+	return nil
+}
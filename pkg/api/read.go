@@ -0,0 +1,50 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// readFromCache follows the resourceVersion semantics of the apiserver: "" asks for the latest state, read from
+// the apiserver, "0" accepts any state, served by the cache if gvk may be cached. Other versions and Exact matches
+// are left to the apiserver.
+func (a *Api) readFromCache(c *gin.Context, gvk runtimeschema.GroupVersionKind) (bool, error) {
+	resourceVersion := c.Query("resourceVersion")
+	match := metav1.ResourceVersionMatch(c.Query("resourceVersionMatch"))
+	switch match {
+	case "":
+	case metav1.ResourceVersionMatchNotOlderThan, metav1.ResourceVersionMatchExact:
+		if resourceVersion == "" {
+			return false, apierrors.NewBadRequest("resourceVersionMatch is forbidden unless resourceVersion is provided")
+		}
+		if match == metav1.ResourceVersionMatchExact && resourceVersion == "0" {
+			return false, apierrors.NewBadRequest(`resourceVersionMatch "Exact" is forbidden for resourceVersion "0"`)
+		}
+	default:
+		return false, apierrors.NewBadRequest(fmt.Sprintf("unsupported resourceVersionMatch %q", match))
+	}
+	return a.clients == nil && resourceVersion == "0" && a.cacheAllowed(gvk), nil
+}
+
+// liveReader reads from the apiserver, as the authenticated user when impersonating.
+func (a *Api) liveReader(c *gin.Context) (client.Reader, error) {
+	if a.clients == nil {
+		return a.mgr.GetAPIReader(), nil
+	}
+	return a.client(c)
+}
+
+// cacheAllowed tells whether gvk is in the cache allowlist, so informers are only started for the kinds it lists.
+func (a *Api) cacheAllowed(gvk runtimeschema.GroupVersionKind) bool {
+	for _, allowed := range a.opts.CacheAllowlist {
+		if (allowed.Group == "*" || allowed.Group == gvk.Group) && (allowed.Kind == "*" || allowed.Kind == gvk.Kind) && (allowed.Version == "" || allowed.Version == gvk.Version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCacheAllowlist(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a"}}
+	for _, tc := range []struct {
+		name      string
+		allowlist []runtimeschema.GroupVersionKind
+		cached    bool
+	}{
+		{"default", nil, false},
+		{"other kinds", []runtimeschema.GroupVersionKind{podGVK}, false},
+		{"kind", []runtimeschema.GroupVersionKind{{Kind: "Secret"}}, true},
+		{"any kind", []runtimeschema.GroupVersionKind{{Group: "*", Kind: "*"}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ta := newTestApi(t, testApiOptions{objects: []client.Object{secret}, opts: Options{CacheAllowlist: tc.allowlist}})
+			for _, path := range []string{"/api/v1/namespaces/default/secrets?resourceVersion=0", "/api/v1/namespaces/default/secrets/a?resourceVersion=0"} {
+				w := ta.do(context.Background(), httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+				}
+			}
+			cachedReads := ta.cached.lists.Load() + ta.cached.gets.Load()
+			liveReads := ta.live.lists.Load() + ta.live.gets.Load()
+			if tc.cached && (cachedReads != 2 || liveReads != 0) || !tc.cached && (cachedReads != 0 || liveReads != 2) {
+				t.Errorf("expected cached reads %v, got %d cached and %d live", tc.cached, cachedReads, liveReads)
+			}
+
+			// kinds that may not be cached may not be watched either
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			w := ta.do(ctx, httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/secrets?watch=true", nil))
+			if forbidden := w.Code == http.StatusForbidden; forbidden == tc.cached {
+				t.Errorf("unexpected watch response %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
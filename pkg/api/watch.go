@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const bookmarkInterval = time.Minute
+
+var (
+	// errWatcherTooSlow ends watches whose queue overflowed, clients are expected to list and watch again.
+	errWatcherTooSlow = apierrors.NewResourceExpired("the watcher could not keep up with the events, list and watch again")
+	// errWatchClosed ends watches of the apiserver it closed, clients watch again as they do when it times out.
+	errWatchClosed = errors.New("the apiserver closed the watch")
+)
+
+// startWatch subscribes e to the hub, the returned queue is fed without ever blocking the informer.
+// stop unsubscribes e, the informer is kept running in between.
+func (a *Api) startWatch(c *gin.Context, gvk runtimeschema.GroupVersionKind, e *WatchEventHandler) (*watchQueue, func(), error) {
+	if a.clients != nil {
+		return a.startImpersonatedWatch(c, gvk, e)
+	}
+	if !a.cacheAllowed(gvk) {
+		return nil, nil, apierrors.NewForbidden(runtimeschema.GroupResource{Group: gvk.Group, Resource: c.Param("resource")}, "",
+			fmt.Errorf("watching %s is not allowed, the kind is not in the cache allowlist", gvk.Kind))
+	}
+	e.queue = newWatchQueue(a.opts.WatchQueueSize, a.opts.WatchBackpressure)
+	a.informers.acquire(gvk)
+	unsubscribe, err := a.hub.subscribe(c.Request.Context(), gvk, e)
+	if err != nil {
+		a.informers.release(gvk)
+		return nil, nil, err
+	}
+	stop := func() {
+		unsubscribe()
+		a.informers.release(gvk)
+	}
+	return e.queue, stop, nil
+}
+
+// startImpersonatedWatch watches the apiserver as the authenticated user instead of subscribing to the hub,
+// so the apiserver authorizes and audits the watch like the other requests when impersonating.
+// The events feed the queue the same way, the queue is closed when the apiserver ends the watch.
+func (a *Api) startImpersonatedWatch(c *gin.Context, gvk runtimeschema.GroupVersionKind, e *WatchEventHandler) (*watchQueue, func(), error) {
+	cli, err := a.clients.clientFor(c.MustGet(auth.ContextKey).(*auth.UserInfo))
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &client.ListOptions{
+		Namespace:     e.Namespace,
+		LabelSelector: e.LabelSelector,
+		FieldSelector: e.FieldSelector,
+		Raw:           &metav1.ListOptions{ResourceVersion: e.ResourceVersion},
+	}
+	if e.Name != "" {
+		selectors := []fields.Selector{fields.OneTermEqualSelector("metadata.name", e.Name)}
+		if e.FieldSelector != nil {
+			selectors = append(selectors, e.FieldSelector)
+		}
+		opts.FieldSelector = andSelectors(selectors)
+	}
+	if e.SkipInitialList {
+		// watches from no resourceVersion start with the existing objects, those from the current one do not
+		current := &unstructured.UnstructuredList{}
+		current.SetGroupVersionKind(gvk)
+		err = cli.List(c.Request.Context(), current, client.InNamespace(e.Namespace), client.Limit(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Raw.ResourceVersion = current.GetResourceVersion()
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk)
+	w, err := cli.Watch(c.Request.Context(), list, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.queue = newWatchQueue(a.opts.WatchQueueSize, a.opts.WatchBackpressure)
+	go func() {
+		defer e.queue.close()
+		for event := range w.ResultChan() {
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event.Object)
+				if err != nil {
+					fmt.Printf("convert watch event error: %s\n", err)
+					continue
+				}
+				obj = &unstructured.Unstructured{Object: content}
+			}
+			e.queue.push(WatchEvent{Type: event.Type, Object: obj})
+		}
+	}()
+	return e.queue, w.Stop, nil
+}
+
+// watchEvents streams newline delimited metav1.WatchEvent frames the way the apiserver does,
+// honoring resourceVersion, allowWatchBookmarks and timeoutSeconds.
+func (a *Api) watchEvents(c *gin.Context, gvk runtimeschema.GroupVersionKind, namespace, name string, selector labels.Selector, fieldSelector fields.Selector) {
+	allowBookmarks, _ := strconv.ParseBool(c.Query("allowWatchBookmarks"))
+	var timeout time.Duration
+	if timeoutSeconds := c.Query("timeoutSeconds"); timeoutSeconds != "" {
+		seconds, err := strconv.ParseInt(timeoutSeconds, 10, 64)
+		if err != nil || seconds < 0 {
+			http_common.Error(c, apierrors.NewBadRequest(fmt.Sprintf("invalid timeoutSeconds %q", timeoutSeconds)))
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	resourceVersion := c.Query("resourceVersion")
+
+	e := &WatchEventHandler{Name: name, Namespace: namespace, LabelSelector: selector, FieldSelector: fieldSelector, ResourceVersion: resourceVersion}
+	queue, stop, err := a.startWatch(c, gvk, e)
+	if apierrors.IsResourceExpired(err) {
+		// like the apiserver, a too old resourceVersion ends the watch with an ERROR event, not an HTTP error
+		c.Header("Content-Type", "application/json")
+		c.Status(http.StatusOK)
+		json.NewEncoder(c.Writer).Encode(&metav1.WatchEvent{Type: string(watch.Error), Object: runtime.RawExtension{Object: http_common.ErrorStatus(err)}})
+		return
+	}
+	if err != nil {
+		http_common.Error(c, err)
+		return
+	}
+	defer stop()
+
+	ctx := c.Request.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var bookmarks <-chan time.Time
+	if allowBookmarks {
+		ticker := time.NewTicker(bookmarkInterval)
+		defer ticker.Stop()
+		bookmarks = ticker.C
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	encoder := json.NewEncoder(c.Writer)
+	write := func(eventType watch.EventType, obj runtime.Object) bool {
+		err := encoder.Encode(&metav1.WatchEvent{Type: string(eventType), Object: runtime.RawExtension{Object: obj}})
+		if err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	lastResourceVersion := resourceVersion
+	rbacChanged := a.rbac.changes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rbacChanged:
+			// the stream ends as soon as the user may no longer watch, objects are never filtered silently
+			rbacChanged = a.rbac.changes()
+			if err := a.reauthorize(c); err != nil {
+				write(watch.Error, http_common.ErrorStatus(err))
+				return
+			}
+		case <-queue.notify:
+			events, err := queue.pop()
+			for _, event := range events {
+				lastResourceVersion = event.Object.GetResourceVersion()
+				if !write(event.Type, event.Object) {
+					return
+				}
+			}
+			if err != nil {
+				if err != errWatchClosed {
+					write(watch.Error, http_common.ErrorStatus(err))
+				}
+				return
+			}
+		case <-bookmarks:
+			if lastResourceVersion == "" || lastResourceVersion == "0" {
+				continue
+			}
+			bookmark := &unstructured.Unstructured{}
+			bookmark.SetGroupVersionKind(gvk)
+			bookmark.SetResourceVersion(lastResourceVersion)
+			if !write(watch.Bookmark, bookmark) {
+				return
+			}
+		}
+	}
+}
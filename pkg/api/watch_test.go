@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// watchOnly grants the watch verb and nothing else.
+type watchOnly struct{}
+
+func (watchOnly) Authorize(_ context.Context, attrs *authorizer.Attributes) (bool, error) {
+	return attrs.Verb == "watch", nil
+}
+
+func TestWatchOnlyCannotList(t *testing.T) {
+	for _, watch := range []string{"true", "1", "yes", "True"} {
+		t.Run(watch, func(t *testing.T) {
+			ta := newTestApi(t, testApiOptions{authz: watchOnly{}, objects: []client.Object{testPod("a")}, opts: Options{CacheAllowlist: []runtimeschema.GroupVersionKind{podGVK}}})
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			w := ta.do(ctx, httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?watch="+watch, nil))
+
+			// whatever value asks for the watch that was authorized, the objects are never listed
+			if w.Code != http.StatusOK || ta.cached.lists.Load() != 0 || ta.live.lists.Load() != 0 || strings.Contains(w.Body.String(), `"items"`) {
+				t.Errorf("watch=%s was served as a list: %d %s", watch, w.Code, w.Body)
+			}
+		})
+	}
+
+	ta := newTestApi(t, testApiOptions{authz: watchOnly{}, objects: []client.Object{testPod("a")}})
+	w := ta.do(context.Background(), httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?watch=0", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected watch=0 to be a forbidden list, got %d %s", w.Code, w.Body)
+	}
+}
@@ -1,15 +1,48 @@
 package auth
 
 import (
-	"sync"
-	"time"
+	"strings"
 )
 
-// TODO redis
-var Cache sync.Map
+// Cache keeps the users of the tokens authenticated recently. main sets it before serving, to a MemoryTokenCache
+// or a RedisTokenCache shared by the replicas.
+var Cache TokenCache
+
+const ContextKey = "userInfo"
+
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
 
 type UserInfo struct {
-	Name      string
-	Namespace string
-	RenewTime time.Time
+	// Username is the full name authenticated by the apiserver, e.g. system:serviceaccount:default:admin.
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+
+	// Name and Namespace are those of the ServiceAccount, other users have their Username as Name and no Namespace.
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Namespaces whose RoleBindings apply to the user, Namespace included.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+func ServiceAccountUsername(namespace, name string) string {
+	return serviceAccountUsernamePrefix + namespace + ":" + name
+}
+
+// ParseServiceAccountUsername splits system:serviceaccount:<namespace>:<name> into its namespace and name.
+func ParseServiceAccountUsername(username string) (string, string, bool) {
+	if !strings.HasPrefix(username, serviceAccountUsernamePrefix) {
+		return "", "", false
+	}
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(username, serviceAccountUsernamePrefix), ":")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, ":") {
+		return "", "", false
+	}
+	return namespace, name, true
+}
+
+// ServiceAccountGroups returns the groups the apiserver puts a ServiceAccount in.
+func ServiceAccountGroups(namespace string) []string {
+	return []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace, "system:authenticated"}
 }
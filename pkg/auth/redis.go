@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix         = "kube-apiserver-proxy:token:"
+	redisRevocationChannel = "kube-apiserver-proxy:token-revocations"
+)
+
+// RedisTokenCache shares the authenticated tokens between the replicas through Redis. Tokens read from Redis
+// are kept in a local cache, revocations are published so every replica evicts them at once.
+type RedisTokenCache struct {
+	client *redis.Client
+	ttl    time.Duration
+	local  *MemoryTokenCache
+}
+
+// NewRedisTokenCache subscribes to revocations until ctx is done, the local cache holds at most maxEntries tokens.
+func NewRedisTokenCache(ctx context.Context, client *redis.Client, ttl time.Duration, maxEntries int) (*RedisTokenCache, error) {
+	r := &RedisTokenCache{client: client, ttl: ttl, local: NewMemoryTokenCache(ctx, ttl, maxEntries)}
+	pubsub := client.Subscribe(ctx, redisRevocationChannel)
+	// wait for the subscription, revocations published before it would be missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	go func() {
+		defer pubsub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-pubsub.Channel():
+				if !ok {
+					return
+				}
+				r.local.delete(msg.Payload)
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *RedisTokenCache) Get(ctx context.Context, token string) (*UserInfo, bool) {
+	key := tokenKey(token)
+	if info, ok := r.local.get(key); ok {
+		return info, true
+	}
+	data, err := r.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			fmt.Printf("get token from redis error: %s\n", err)
+		}
+		return nil, false
+	}
+	entry := &tokenCacheEntry{Key: key}
+	if err = json.Unmarshal(data, entry); err != nil {
+		fmt.Printf("decode token from redis error: %s\n", err)
+		return nil, false
+	}
+	if !entry.Expire.After(time.Now()) {
+		return nil, false
+	}
+	r.local.set(entry)
+	return entry.Info, true
+}
+
+func (r *RedisTokenCache) Set(ctx context.Context, token string, info *UserInfo) error {
+	entry := &tokenCacheEntry{Key: tokenKey(token), Info: info, Expire: tokenExpire(token, r.ttl)}
+	ttl := time.Until(entry.Expire)
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = r.client.Set(ctx, redisKeyPrefix+entry.Key, data, ttl).Err(); err != nil {
+		return err
+	}
+	r.local.set(entry)
+	return nil
+}
+
+// Delete removes the token from Redis and from the local cache of every replica.
+func (r *RedisTokenCache) Delete(ctx context.Context, token string) error {
+	key := tokenKey(token)
+	r.local.delete(key)
+	if err := r.client.Del(ctx, redisKeyPrefix+key).Err(); err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, redisRevocationChannel, key).Err()
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// jwtWithExp returns a token carrying the exp claim, only the claim matters to the cache.
+func jwtWithExp(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".signature"
+}
+
+// newRedisTokenCaches returns replicas sharing one in-process Redis.
+func newRedisTokenCaches(t *testing.T, ttl time.Duration, replicas int) (*miniredis.Miniredis, []*RedisTokenCache) {
+	m := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	caches := make([]*RedisTokenCache, replicas)
+	for i := range caches {
+		client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+		t.Cleanup(func() { client.Close() })
+		c, err := NewRedisTokenCache(ctx, client, ttl, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caches[i] = c
+	}
+	return m, caches
+}
+
+func TestRedisTokenCacheSetGet(t *testing.T) {
+	_, caches := newRedisTokenCaches(t, time.Minute, 2)
+	ctx := context.Background()
+	info := &UserInfo{Username: "system:serviceaccount:default:alice", Groups: ServiceAccountGroups("default"), Name: "alice", Namespace: "default", Namespaces: []string{"default"}}
+
+	if err := caches[0].Set(ctx, "token", info); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range caches {
+		got, ok := c.Get(ctx, "token")
+		if !ok || !reflect.DeepEqual(got, info) {
+			t.Errorf("replica %d got %+v, %v, want %+v", i, got, ok, info)
+		}
+	}
+	if _, ok := caches[1].Get(ctx, "other"); ok {
+		t.Error("an unknown token was found")
+	}
+}
+
+func TestRedisTokenCacheTTL(t *testing.T) {
+	m, caches := newRedisTokenCaches(t, time.Minute, 2)
+	ctx := context.Background()
+	info := &UserInfo{Username: "alice"}
+
+	if err := caches[0].Set(ctx, "token", info); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(redisKeyPrefix + tokenKey("token")); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("token without exp stored for %s, want the TTL of the cache", ttl)
+	}
+
+	expiring := jwtWithExp(time.Now().Add(20 * time.Second))
+	if err := caches[0].Set(ctx, expiring, info); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(redisKeyPrefix + tokenKey(expiring)); ttl <= 0 || ttl > 20*time.Second {
+		t.Errorf("token expiring in 20s stored for %s", ttl)
+	}
+
+	expired := jwtWithExp(time.Now().Add(-time.Second))
+	if err := caches[0].Set(ctx, expired, info); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(redisKeyPrefix + tokenKey(expired)) {
+		t.Error("an expired token was stored")
+	}
+
+	// the second replica has nothing locally and must not find the tokens once Redis expired them
+	m.FastForward(2 * time.Minute)
+	for _, token := range []string{"token", expiring} {
+		if _, ok := caches[1].Get(ctx, token); ok {
+			t.Errorf("token %q outlived its TTL", token)
+		}
+	}
+}
+
+func TestRedisTokenCacheRevocation(t *testing.T) {
+	m, caches := newRedisTokenCaches(t, time.Minute, 2)
+	ctx := context.Background()
+
+	if err := caches[0].Set(ctx, "token", &UserInfo{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	// the second replica keeps the token locally from now on
+	if _, ok := caches[1].Get(ctx, "token"); !ok {
+		t.Fatal("the token is not shared")
+	}
+
+	if err := caches[0].Delete(ctx, "token"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(redisKeyPrefix + tokenKey("token")) {
+		t.Error("the token is still in Redis")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := caches[1].local.get(tokenKey("token")); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the revocation did not reach the local cache of the second replica")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := caches[0].Get(ctx, "token"); ok {
+		t.Error("the revoked token is still found")
+	}
+}
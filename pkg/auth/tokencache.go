@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTokenCacheTTL  = 5 * time.Second
+	DefaultTokenCacheSize = 10000
+)
+
+// TokenCache keeps the UserInfo of authenticated tokens until the exp claim of the token or the TTL of the cache,
+// whichever comes first. Deleting a token revokes it.
+type TokenCache interface {
+	Get(ctx context.Context, token string) (*UserInfo, bool)
+	Set(ctx context.Context, token string, info *UserInfo) error
+	Delete(ctx context.Context, token string) error
+}
+
+// tokenKey is the SHA-256 of the full token, tokens of an issuer share their first bytes.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpire returns when a token is no longer trusted: after ttl, sooner if its exp claim says so.
+// The claim is read without verifying the token, it only ever shortens how long the token is cached.
+func tokenExpire(token string, ttl time.Duration) time.Time {
+	expire := time.Now().Add(ttl)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return expire
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return expire
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return expire
+	}
+	if exp := time.Unix(claims.Exp, 0); exp.Before(expire) {
+		return exp
+	}
+	return expire
+}
+
+type tokenCacheEntry struct {
+	Key    string    `json:"-"`
+	Info   *UserInfo `json:"info"`
+	Expire time.Time `json:"expire"`
+}
+
+// MemoryTokenCache is the TokenCache of a single replica, holding at most maxEntries tokens
+// and evicting the least recently used first.
+type MemoryTokenCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *tokenCacheEntry, most recently used first
+	lru *list.List
+}
+
+// NewMemoryTokenCache drops expired tokens in the background until ctx is done.
+func NewMemoryTokenCache(ctx context.Context, ttl time.Duration, maxEntries int) *MemoryTokenCache {
+	m := &MemoryTokenCache{ttl: ttl, maxEntries: maxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+	if ttl > 0 {
+		go m.janitor(ctx)
+	}
+	return m
+}
+
+func (m *MemoryTokenCache) Get(ctx context.Context, token string) (*UserInfo, bool) {
+	return m.get(tokenKey(token))
+}
+
+func (m *MemoryTokenCache) Set(ctx context.Context, token string, info *UserInfo) error {
+	m.set(&tokenCacheEntry{Key: tokenKey(token), Info: info, Expire: tokenExpire(token, m.ttl)})
+	return nil
+}
+
+func (m *MemoryTokenCache) Delete(ctx context.Context, token string) error {
+	m.delete(tokenKey(token))
+	return nil
+}
+
+func (m *MemoryTokenCache) get(key string) (*UserInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if !entry.Expire.After(time.Now()) {
+		m.lru.Remove(element)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.lru.MoveToFront(element)
+	return entry.Info, true
+}
+
+func (m *MemoryTokenCache) set(entry *tokenCacheEntry) {
+	if !entry.Expire.After(time.Now()) || m.maxEntries <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[entry.Key]; ok {
+		element.Value = entry
+		m.lru.MoveToFront(element)
+		return
+	}
+	m.entries[entry.Key] = m.lru.PushFront(entry)
+	for m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*tokenCacheEntry).Key)
+	}
+}
+
+func (m *MemoryTokenCache) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		m.lru.Remove(element)
+		delete(m.entries, key)
+	}
+}
+
+func (m *MemoryTokenCache) janitor(ctx context.Context) {
+	ticker := time.NewTicker(max(m.ttl, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for key, element := range m.entries {
+				if !element.Value.(*tokenCacheEntry).Expire.After(now) {
+					m.lru.Remove(element)
+					delete(m.entries, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AllAuthenticated is the group of every authenticated user.
+const AllAuthenticated = "system:authenticated"
+
+// Info is the identity a request is authenticated as.
+type Info struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string][]string
+}
+
+// Authenticator authenticates requests, ok is false if the request carries no credentials it accepts.
+type Authenticator interface {
+	AuthenticateRequest(req *http.Request) (info *Info, ok bool, err error)
+}
+
+// Token authenticates bearer tokens, ok is false if the token is not authenticated.
+type Token interface {
+	AuthenticateToken(ctx context.Context, token string) (info *Info, ok bool, err error)
+}
+
+// BearerToken returns the token of the Authorization header, "" if there is none.
+func BearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+type bearerToken struct {
+	token Token
+}
+
+// NewBearerToken authenticates the bearer token of requests with token.
+func NewBearerToken(token Token) Authenticator {
+	return &bearerToken{token: token}
+}
+
+func (b *bearerToken) AuthenticateRequest(req *http.Request) (*Info, bool, error) {
+	token := BearerToken(req)
+	if token == "" {
+		return nil, false, nil
+	}
+	return b.token.AuthenticateToken(req.Context(), token)
+}
+
+type authenticatedGroupAdder struct {
+	authenticator Authenticator
+}
+
+// NewAuthenticatedGroupAdder puts every identity authenticator authenticates in AllAuthenticated,
+// as the apiserver does, so bindings such as system:basic-user and system:discovery apply.
+func NewAuthenticatedGroupAdder(authenticator Authenticator) Authenticator {
+	return &authenticatedGroupAdder{authenticator: authenticator}
+}
+
+func (g *authenticatedGroupAdder) AuthenticateRequest(req *http.Request) (*Info, bool, error) {
+	info, ok, err := g.authenticator.AuthenticateRequest(req)
+	if !ok || slices.Contains(info.Groups, AllAuthenticated) {
+		return info, ok, err
+	}
+	withGroup := *info
+	withGroup.Groups = append(slices.Clip(info.Groups), AllAuthenticated)
+	return &withGroup, true, err
+}
+
+// Union tries its authenticators in order, the first to authenticate the request wins.
+// The errors of the others are only returned if none does.
+type Union []Authenticator
+
+func (u Union) AuthenticateRequest(req *http.Request) (*Info, bool, error) {
+	var errs []error
+	for _, authenticator := range u {
+		info, ok, err := authenticator.AuthenticateRequest(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			return info, true, nil
+		}
+	}
+	return nil, false, errors.Join(errs...)
+}
+
+// UnionToken tries its token authenticators in order, as Union does.
+type UnionToken []Token
+
+func (u UnionToken) AuthenticateToken(ctx context.Context, token string) (*Info, bool, error) {
+	var errs []error
+	for _, authenticator := range u {
+		info, ok, err := authenticator.AuthenticateToken(ctx, token)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			return info, true, nil
+		}
+	}
+	return nil, false, errors.Join(errs...)
+}
@@ -0,0 +1,114 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// tokenFunc authenticates tokens with a func.
+type tokenFunc func(token string) (*Info, bool, error)
+
+func (f tokenFunc) AuthenticateToken(_ context.Context, token string) (*Info, bool, error) {
+	return f(token)
+}
+
+func TestChain(t *testing.T) {
+	ca := newTestCA(t)
+	static, err := NewStaticTokensFromFile(writeTokenFile(t, "static,bob,2,dev\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errReview := errors.New("tokenreview failed")
+	review := tokenFunc(func(token string) (*Info, bool, error) {
+		switch token {
+		case "reviewed":
+			return &Info{Name: "carol", Groups: []string{AllAuthenticated}}, true, nil
+		case "failing":
+			return nil, false, errReview
+		}
+		return nil, false, nil
+	})
+	// ordered like main: client certificates, then the token authenticators
+	chain := NewAuthenticatedGroupAdder(Union{ca.authenticator(t), NewBearerToken(UnionToken{static, review})})
+
+	request := func(cert *x509.Certificate, token string) *http.Request {
+		req := requestWithCert(cert)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	alice := ca.issue(t, pkix.Name{CommonName: "alice"}, x509.ExtKeyUsageClientAuth)
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		user   string
+		groups []string
+		err    error
+	}{
+		{"certificate first", request(alice, "static"), "alice", []string{AllAuthenticated}, nil},
+		{"static token", request(nil, "static"), "bob", []string{"dev", AllAuthenticated}, nil},
+		{"next token authenticator", request(nil, "reviewed"), "carol", []string{AllAuthenticated}, nil},
+		{"unknown token", request(nil, "unknown"), "", nil, nil},
+		{"no credentials", request(nil, ""), "", nil, nil},
+		{"failing authenticator", request(nil, "failing"), "", nil, errReview},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, ok, err := chain.AuthenticateRequest(tc.req)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tc.user == "" {
+				if ok {
+					t.Errorf("expected no identity, got %+v", info)
+				}
+				return
+			}
+			if !ok || info.Name != tc.user || !slices.Equal(info.Groups, tc.groups) {
+				t.Errorf("expected %s in %v, got %+v", tc.user, tc.groups, info)
+			}
+		})
+	}
+}
+
+func TestUnionErrors(t *testing.T) {
+	errFirst := errors.New("first")
+	failing := tokenFunc(func(string) (*Info, bool, error) { return nil, false, errFirst })
+	accepting := tokenFunc(func(string) (*Info, bool, error) { return &Info{Name: "alice"}, true, nil })
+
+	// errors of an authenticator do not matter once another one authenticates the token
+	info, ok, err := UnionToken{failing, accepting}.AuthenticateToken(context.Background(), "token")
+	if err != nil || !ok || info.Name != "alice" {
+		t.Errorf("unexpected result %+v, %v, %v", info, ok, err)
+	}
+	_, ok, err = UnionToken{failing}.AuthenticateToken(context.Background(), "token")
+	if ok || !errors.Is(err, errFirst) {
+		t.Errorf("expected the error of the authenticator, got %v, %v", ok, err)
+	}
+}
+
+func TestKeysUnavailable(t *testing.T) {
+	key := newTestKey(t, "kid")
+	keys := &KeySet{
+		discoveryURL: "/.well-known/openid-configuration",
+		get: func(context.Context, string) ([]byte, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	oidc := NewOIDC(keys, "https://idp.example.com", "proxy", OIDCClaims{})
+	token := key.sign(t, jwt.Claims{Issuer: "https://idp.example.com", Audience: jwt.Audience{"proxy"}}, map[string]interface{}{"email": "alice@example.com"})
+
+	// a token that cannot be verified is an error, not a failed authentication
+	_, ok, err := oidc.AuthenticateToken(context.Background(), token)
+	if ok || !errors.Is(err, ErrKeysUnavailable) {
+		t.Errorf("expected the keys to be unavailable, got %v, %v", ok, err)
+	}
+}
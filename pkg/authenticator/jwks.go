@@ -0,0 +1,202 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// keySetMaxAge is how long the keys are used before they are fetched again.
+	keySetMaxAge = time.Hour
+	// keySetMinRefresh limits how often unknown key ids make the keys be fetched again.
+	keySetMinRefresh = 10 * time.Second
+	// keySetMaxBackoff bounds the wait after failed fetches, which doubles from keySetMinRefresh.
+	keySetMaxBackoff = 5 * time.Minute
+)
+
+var (
+	errUnknownKey = errors.New("no key matches the token")
+	// ErrKeysUnavailable wraps the failures to fetch the keys, tokens could not be verified at all.
+	ErrKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+// ProviderMetadata is the part of an OpenID provider's discovery document the proxy uses.
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// KeySet holds the metadata and signing keys an OpenID provider publishes through its discovery document
+// and JWKS, fetched once and again when they get old or a token is signed by an unknown key.
+type KeySet struct {
+	discoveryURL string
+	get          func(ctx context.Context, url string) ([]byte, error)
+
+	mu       sync.RWMutex
+	metadata ProviderMetadata
+	keys     *jose.JSONWebKeySet
+	fetched  time.Time
+	// after failed fetches, lastErr is returned without fetching again until retryAfter
+	failures   int
+	lastErr    error
+	retryAfter time.Time
+}
+
+// NewKeySet reads the discovery document of issuerURL with httpClient.
+func NewKeySet(httpClient *http.Client, issuerURL string) *KeySet {
+	return &KeySet{
+		discoveryURL: strings.TrimSuffix(issuerURL, "/") + "/.well-known/openid-configuration",
+		get: func(ctx context.Context, url string) ([]byte, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("get %s: %s", url, resp.Status)
+			}
+			return io.ReadAll(resp.Body)
+		},
+	}
+}
+
+// NewClusterKeySet reads the ServiceAccount issuer discovery of the apiserver. The JWKS is read through
+// the apiserver too, whatever host the discovery document names.
+func NewClusterKeySet(config *rest.Config) (*KeySet, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{
+		discoveryURL: "/.well-known/openid-configuration",
+		get: func(ctx context.Context, rawURL string) ([]byte, error) {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, err
+			}
+			return client.RESTClient().Get().AbsPath(u.Path).Do(ctx).Raw()
+		},
+	}, nil
+}
+
+// Metadata returns the discovery document.
+func (k *KeySet) Metadata(ctx context.Context) (ProviderMetadata, error) {
+	k.mu.RLock()
+	metadata, fresh := k.metadata, time.Since(k.fetched) < keySetMaxAge
+	k.mu.RUnlock()
+	if fresh {
+		return metadata, nil
+	}
+	if err := k.refresh(ctx); err != nil {
+		return ProviderMetadata{}, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.metadata, nil
+}
+
+// Key returns the key of the given id, refreshing the keys if none matches, they may have been rotated.
+func (k *KeySet) Key(ctx context.Context, keyID string) (*jose.JSONWebKey, error) {
+	if key, fresh := k.lookup(keyID); key != nil && fresh {
+		return key, nil
+	}
+	k.mu.RLock()
+	recent := time.Since(k.fetched) < keySetMinRefresh
+	k.mu.RUnlock()
+	if !recent {
+		if err := k.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if key, _ := k.lookup(keyID); key != nil {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+func (k *KeySet) lookup(keyID string) (*jose.JSONWebKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.keys == nil {
+		return nil, false
+	}
+	fresh := time.Since(k.fetched) < keySetMaxAge
+	for i, key := range k.keys.Keys {
+		// keys without an id match tokens without one
+		if key.KeyID == keyID && key.Use != "enc" {
+			return &k.keys.Keys[i], fresh
+		}
+	}
+	return nil, fresh
+}
+
+func (k *KeySet) refresh(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// another caller may have refreshed while this one waited for the lock
+	if time.Since(k.fetched) < keySetMinRefresh {
+		return nil
+	}
+	// every token would fetch again while the provider is down
+	if time.Now().Before(k.retryAfter) {
+		return k.lastErr
+	}
+
+	metadata, keys, err := k.fetch(ctx)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrKeysUnavailable, err)
+		k.failures++
+		k.lastErr, k.retryAfter = err, time.Now().Add(keySetBackoff(k.failures))
+		return err
+	}
+	k.metadata, k.keys, k.fetched = metadata, keys, time.Now()
+	k.failures, k.lastErr, k.retryAfter = 0, nil, time.Time{}
+	return nil
+}
+
+func (k *KeySet) fetch(ctx context.Context) (ProviderMetadata, *jose.JSONWebKeySet, error) {
+	data, err := k.get(ctx, k.discoveryURL)
+	if err != nil {
+		return ProviderMetadata{}, nil, fmt.Errorf("get openid configuration: %w", err)
+	}
+	metadata := ProviderMetadata{}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return ProviderMetadata{}, nil, fmt.Errorf("decode openid configuration: %w", err)
+	}
+	data, err = k.get(ctx, metadata.JWKSURI)
+	if err != nil {
+		return ProviderMetadata{}, nil, fmt.Errorf("get jwks: %w", err)
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err = json.Unmarshal(data, keys); err != nil {
+		return ProviderMetadata{}, nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	return metadata, keys, nil
+}
+
+// keySetBackoff is the wait after the given number of failed fetches in a row.
+func keySetBackoff(failures int) time.Duration {
+	backoff := keySetMinRefresh
+	for i := 1; i < failures && backoff < keySetMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, keySetMaxBackoff)
+}
@@ -0,0 +1,72 @@
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeySetBackoff(t *testing.T) {
+	var fetches int
+	down := true
+	keys := &KeySet{
+		discoveryURL: "/.well-known/openid-configuration",
+		get: func(ctx context.Context, url string) ([]byte, error) {
+			fetches++
+			if down {
+				return nil, errors.New("connection refused")
+			}
+			if url == "/keys" {
+				return []byte(`{"keys":[]}`), nil
+			}
+			return []byte(`{"issuer":"https://kubernetes.default.svc","jwks_uri":"/keys"}`), nil
+		},
+	}
+	ctx := context.Background()
+
+	// failures are not fetched again by every token until the backoff passed
+	for i := 0; i < 3; i++ {
+		if _, err := keys.Metadata(ctx); err == nil {
+			t.Fatal("expected the failed fetch to be returned")
+		}
+		if _, err := keys.Key(ctx, "kid"); err == nil || errors.Is(err, errUnknownKey) {
+			t.Fatalf("expected the failed fetch to be returned, got %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected a single fetch during the backoff, got %d", fetches)
+	}
+
+	keys.retryAfter = time.Now()
+	if _, err := keys.Metadata(ctx); err == nil {
+		t.Fatal("expected the failed fetch to be returned")
+	}
+	if fetches != 2 || time.Until(keys.retryAfter) <= keySetMinRefresh {
+		t.Errorf("expected the backoff to grow after %d fetches, retry in %s", fetches, time.Until(keys.retryAfter))
+	}
+
+	down = false
+	keys.retryAfter = time.Now()
+	metadata, err := keys.Metadata(ctx)
+	if err != nil || metadata.Issuer != "https://kubernetes.default.svc" {
+		t.Fatalf("unexpected metadata %+v, %v", metadata, err)
+	}
+	if keys.failures != 0 || keys.lastErr != nil {
+		t.Errorf("the backoff was not reset after fetching: %d failures, %v", keys.failures, keys.lastErr)
+	}
+}
+
+func TestKeySetBackoffDuration(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:  keySetMinRefresh,
+		2:  2 * keySetMinRefresh,
+		3:  4 * keySetMinRefresh,
+		10: keySetMaxBackoff,
+		99: keySetMaxBackoff,
+	} {
+		if backoff := keySetBackoff(failures); backoff != expected {
+			t.Errorf("backoff after %d failures is %s, expected %s", failures, backoff, expected)
+		}
+	}
+}
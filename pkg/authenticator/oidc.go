@@ -0,0 +1,121 @@
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// OIDCClaims tell which claims of an ID token identify the user. The prefixes keep the users and groups
+// of the provider apart from local users and system groups.
+type OIDCClaims struct {
+	UsernameClaim  string
+	UsernamePrefix string
+	GroupsClaim    string
+	GroupsPrefix   string
+}
+
+// OIDC verifies the ID tokens an OpenID provider issues to a client, and authenticates them as bearer tokens.
+type OIDC struct {
+	keys      *KeySet
+	issuerURL string
+	clientID  string
+	claims    OIDCClaims
+}
+
+func NewOIDC(keys *KeySet, issuerURL, clientID string, claims OIDCClaims) *OIDC {
+	if claims.UsernameClaim == "" {
+		claims.UsernameClaim = "email"
+	}
+	return &OIDC{keys: keys, issuerURL: issuerURL, clientID: clientID, claims: claims}
+}
+
+// Metadata returns the discovery document of the provider.
+func (o *OIDC) Metadata(ctx context.Context) (ProviderMetadata, error) {
+	return o.keys.Metadata(ctx)
+}
+
+// AuthenticateToken leaves tokens of other issuers to the next authenticators. Tokens cannot be verified
+// while the keys of the provider are unavailable, that error is returned.
+func (o *OIDC) AuthenticateToken(ctx context.Context, token string) (*Info, bool, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, false, nil
+	}
+	unverified := jwt.Claims{}
+	if err = parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil || unverified.Issuer != o.issuerURL {
+		return nil, false, nil
+	}
+	claims, err := o.VerifyIDToken(ctx, token)
+	if errors.Is(err, ErrKeysUnavailable) {
+		return nil, false, err
+	}
+	if err != nil {
+		fmt.Printf("verify oidc token error: %s\n", err)
+		return nil, false, nil
+	}
+	info, err := o.Identity(claims)
+	if err != nil {
+		fmt.Printf("oidc token identity error: %s\n", err)
+		return nil, false, nil
+	}
+	return info, true, nil
+}
+
+// VerifyIDToken checks the signature, iss, aud, exp and nbf of an ID token and returns all of its claims.
+func (o *OIDC) VerifyIDToken(ctx context.Context, rawIDToken string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed.Headers) != 1 {
+		return nil, errors.New("id token must have exactly one signature")
+	}
+	key, err := o.keys.Key(ctx, parsed.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+	claims, all := jwt.Claims{}, map[string]interface{}{}
+	if err = parsed.Claims(key, &claims, &all); err != nil {
+		return nil, err
+	}
+	// the issuer must be the configured one exactly, as the discovery document is trusted for it only
+	if err = claims.ValidateWithLeeway(jwt.Expected{Issuer: o.issuerURL, Time: time.Now()}, jwtLeeway); err != nil {
+		return nil, err
+	}
+	if !claims.Audience.Contains(o.clientID) {
+		return nil, jwt.ErrInvalidAudience
+	}
+	return all, nil
+}
+
+// Identity maps the claims of a verified ID token to the prefixed user name and groups.
+func (o *OIDC) Identity(claims map[string]interface{}) (*Info, error) {
+	username, _ := claims[o.claims.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("id token has no %s claim", o.claims.UsernameClaim)
+	}
+	if o.claims.UsernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return nil, errors.New("email of the id token is not verified")
+		}
+	}
+	info := &Info{Name: o.claims.UsernamePrefix + username}
+	if subject, ok := claims["sub"].(string); ok {
+		info.UID = subject
+	}
+	switch groups := claims[o.claims.GroupsClaim].(type) {
+	case string:
+		info.Groups = []string{o.claims.GroupsPrefix + groups}
+	case []interface{}:
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				info.Groups = append(info.Groups, o.claims.GroupsPrefix+group)
+			}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,146 @@
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// jwtLeeway is the clock skew tolerated on exp and nbf, as the apiserver does.
+const jwtLeeway = time.Minute
+
+// errNotLocal makes ServiceAccountToken leave a token to its fallback.
+var errNotLocal = errors.New("token cannot be verified locally")
+
+type serviceAccountClaims struct {
+	Kubernetes struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"serviceaccount"`
+		Pod    *boundObject `json:"pod,omitempty"`
+		Secret *boundObject `json:"secret,omitempty"`
+		Node   *boundObject `json:"node,omitempty"`
+	} `json:"kubernetes.io"`
+}
+
+type boundObject struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// ServiceAccountToken verifies the signature, exp, nbf, iss and aud of ServiceAccount tokens against the keys
+// the apiserver publishes, and that their ServiceAccount still exists in the cache. Tokens bound to a pod,
+// secret or node, tokens signed by unknown keys and tokens whose ServiceAccount is not cached yet are left
+// to fallback, the TokenReview.
+type ServiceAccountToken struct {
+	keys *KeySet
+	// audiences the token must have one of, the issuer if empty
+	audiences []string
+	reader    client.Reader
+	fallback  Token
+}
+
+func NewServiceAccountToken(keys *KeySet, audiences []string, reader client.Reader, fallback Token) *ServiceAccountToken {
+	return &ServiceAccountToken{keys: keys, audiences: audiences, reader: reader, fallback: fallback}
+}
+
+func (s *ServiceAccountToken) AuthenticateToken(ctx context.Context, token string) (*Info, bool, error) {
+	info, err := s.verify(ctx, token)
+	if errors.Is(err, errNotLocal) {
+		return s.fallback.AuthenticateToken(ctx, token)
+	}
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) {
+		return nil, false, err
+	}
+	if err != nil {
+		fmt.Printf("verify serviceaccount token error: %s\n", err)
+		return nil, false, nil
+	}
+	return info, true, nil
+}
+
+func (s *ServiceAccountToken) verify(ctx context.Context, token string) (*Info, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil || len(parsed.Headers) != 1 {
+		return nil, errNotLocal
+	}
+	metadata, err := s.keys.Metadata(ctx)
+	if err != nil {
+		fmt.Printf("get serviceaccount issuer error: %s\n", err)
+		return nil, errNotLocal
+	}
+	issuer := metadata.Issuer
+	// tokens of other issuers, such as legacy Secret tokens, are reviewed by the apiserver
+	unverified := jwt.Claims{}
+	if err = parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil || unverified.Issuer != issuer {
+		return nil, errNotLocal
+	}
+	key, err := s.keys.Key(ctx, parsed.Headers[0].KeyID)
+	if err != nil {
+		return nil, errNotLocal
+	}
+
+	claims, private := jwt.Claims{}, serviceAccountClaims{}
+	if err = parsed.Claims(key, &claims, &private); err != nil {
+		return nil, err
+	}
+	if err = claims.ValidateWithLeeway(jwt.Expected{Issuer: issuer, Time: time.Now()}, jwtLeeway); err != nil {
+		return nil, err
+	}
+	if !s.audienceMatches(claims.Audience, issuer) {
+		return nil, jwt.ErrInvalidAudience
+	}
+
+	k8s := private.Kubernetes
+	if k8s.Pod != nil || k8s.Secret != nil || k8s.Node != nil {
+		return nil, errNotLocal
+	}
+	if k8s.Namespace == "" || k8s.ServiceAccount.Name == "" || claims.Subject != auth.ServiceAccountUsername(k8s.Namespace, k8s.ServiceAccount.Name) {
+		return nil, errors.New("token does not name its serviceaccount")
+	}
+	sa := &corev1.ServiceAccount{}
+	err = s.reader.Get(ctx, types.NamespacedName{Namespace: k8s.Namespace, Name: k8s.ServiceAccount.Name}, sa)
+	if apierrors.IsNotFound(err) {
+		return nil, errNotLocal
+	}
+	if err != nil {
+		return nil, apierrors.NewInternalError(err)
+	}
+	// a ServiceAccount deleted and created again with the same name does not revive its tokens
+	if string(sa.UID) != k8s.ServiceAccount.UID {
+		return nil, fmt.Errorf("serviceaccount %s/%s uid is %s, not %s", sa.Namespace, sa.Name, sa.UID, k8s.ServiceAccount.UID)
+	}
+
+	info := &Info{
+		Name:   claims.Subject,
+		UID:    string(sa.UID),
+		Groups: auth.ServiceAccountGroups(k8s.Namespace),
+	}
+	if claims.ID != "" {
+		info.Extra = map[string][]string{"authentication.kubernetes.io/credential-id": {"JTI=" + claims.ID}}
+	}
+	return info, nil
+}
+
+func (s *ServiceAccountToken) audienceMatches(audience jwt.Audience, issuer string) bool {
+	if len(s.audiences) == 0 {
+		return audience.Contains(issuer)
+	}
+	for _, expected := range s.audiences {
+		if audience.Contains(expected) {
+			return true
+		}
+	}
+	return false
+}
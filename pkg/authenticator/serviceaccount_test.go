@@ -0,0 +1,198 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const testIssuer = "https://kubernetes.default.svc"
+
+type testKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+func newTestKey(t *testing.T, id string) testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{id: id, key: key}
+}
+
+func (k testKey) sign(t *testing.T, claims jwt.Claims, private map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: k.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", k.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(private).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testKeySet publishes the public keys of *published.
+func testKeySet(published *[]testKey) *KeySet {
+	return &KeySet{
+		discoveryURL: "/.well-known/openid-configuration",
+		get: func(ctx context.Context, url string) ([]byte, error) {
+			if url == "/keys" {
+				keys := &jose.JSONWebKeySet{}
+				for _, k := range *published {
+					keys.Keys = append(keys.Keys, jose.JSONWebKey{Key: &k.key.PublicKey, KeyID: k.id, Algorithm: "RS256", Use: "sig"})
+				}
+				return json.Marshal(keys)
+			}
+			return json.Marshal(&ProviderMetadata{Issuer: testIssuer, JWKSURI: "/keys"})
+		},
+	}
+}
+
+// fallbackToken authenticates every token as fallback, as the TokenReview would.
+type fallbackToken struct{}
+
+func (fallbackToken) AuthenticateToken(context.Context, string) (*Info, bool, error) {
+	return &Info{Name: "fallback"}, true, nil
+}
+
+func serviceAccountClaimsOf(name, uid string) map[string]interface{} {
+	return map[string]interface{}{"kubernetes.io": map[string]interface{}{
+		"namespace":      "default",
+		"serviceaccount": map[string]interface{}{"name": name, "uid": uid},
+	}}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	current, other := newTestKey(t, "current"), newTestKey(t, "other")
+	published := []testKey{current}
+	reader := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sa", UID: "uid-1"}},
+	).Build()
+
+	now := time.Now()
+	valid := jwt.Claims{
+		Issuer:   testIssuer,
+		Subject:  "system:serviceaccount:default:sa",
+		Audience: jwt.Audience{testIssuer},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(now),
+		ID:       "jti",
+	}
+	with := func(change func(*jwt.Claims)) jwt.Claims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+	secretBound := serviceAccountClaimsOf("sa", "uid-1")
+	secretBound["kubernetes.io"].(map[string]interface{})["secret"] = map[string]interface{}{"name": "sa-token", "uid": "uid-2"}
+
+	for _, tc := range []struct {
+		name      string
+		token     string
+		audiences []string
+		// expected is the name authenticated, "" if rejected
+		expected string
+	}{
+		{"valid", current.sign(t, valid, serviceAccountClaimsOf("sa", "uid-1")), nil, valid.Subject},
+		{"signed by another key", other.sign(t, valid, serviceAccountClaimsOf("sa", "uid-1")), nil, "fallback"},
+		{"forged signature", testKey{id: "current", key: other.key}.sign(t, valid, serviceAccountClaimsOf("sa", "uid-1")), nil, ""},
+		{"expired", current.sign(t, with(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(now.Add(-2 * jwtLeeway)) }), serviceAccountClaimsOf("sa", "uid-1")), nil, ""},
+		{"expired within the leeway", current.sign(t, with(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(now.Add(-jwtLeeway / 2)) }), serviceAccountClaimsOf("sa", "uid-1")), nil, valid.Subject},
+		{"not yet valid", current.sign(t, with(func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(2 * jwtLeeway)) }), serviceAccountClaimsOf("sa", "uid-1")), nil, ""},
+		{"other audience", current.sign(t, with(func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} }), serviceAccountClaimsOf("sa", "uid-1")), nil, ""},
+		{"configured audience", current.sign(t, with(func(c *jwt.Claims) { c.Audience = jwt.Audience{"proxy"} }), serviceAccountClaimsOf("sa", "uid-1")), []string{"proxy"}, valid.Subject},
+		{"issuer audience not configured", current.sign(t, valid, serviceAccountClaimsOf("sa", "uid-1")), []string{"proxy"}, ""},
+		{"other issuer", current.sign(t, with(func(c *jwt.Claims) { c.Issuer = "kubernetes/serviceaccount" }), serviceAccountClaimsOf("sa", "uid-1")), nil, "fallback"},
+		{"other subject", current.sign(t, with(func(c *jwt.Claims) { c.Subject = "system:serviceaccount:default:admin" }), serviceAccountClaimsOf("sa", "uid-1")), nil, ""},
+		{"recreated serviceaccount", current.sign(t, valid, serviceAccountClaimsOf("sa", "uid-0")), nil, ""},
+		{"serviceaccount not cached", current.sign(t, with(func(c *jwt.Claims) { c.Subject = "system:serviceaccount:default:new" }), serviceAccountClaimsOf("new", "uid-3")), nil, "fallback"},
+		{"bound to a secret", current.sign(t, valid, secretBound), nil, "fallback"},
+		{"not a jwt", "opaque", nil, "fallback"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServiceAccountToken(testKeySet(&published), tc.audiences, reader, fallbackToken{})
+			info, ok, err := s.AuthenticateToken(context.Background(), tc.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expected == "" {
+				if ok {
+					t.Errorf("expected the token to be rejected, got %+v", info)
+				}
+				return
+			}
+			if !ok || info.Name != tc.expected {
+				t.Fatalf("expected %s, got %+v, %v", tc.expected, info, ok)
+			}
+			if tc.expected == valid.Subject && (info.UID != "uid-1" || info.Extra["authentication.kubernetes.io/credential-id"][0] != "JTI=jti") {
+				t.Errorf("unexpected identity %+v", info)
+			}
+		})
+	}
+}
+
+func TestServiceAccountTokenKeyRotation(t *testing.T) {
+	old, rotated := newTestKey(t, "old"), newTestKey(t, "rotated")
+	published := []testKey{old}
+	reader := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sa", UID: "uid-1"}},
+	).Build()
+	keys := testKeySet(&published)
+	s := NewServiceAccountToken(keys, nil, reader, fallbackToken{})
+	claims := jwt.Claims{Issuer: testIssuer, Subject: "system:serviceaccount:default:sa", Audience: jwt.Audience{testIssuer}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	info, ok, err := s.AuthenticateToken(context.Background(), old.sign(t, claims, serviceAccountClaimsOf("sa", "uid-1")))
+	if err != nil || !ok || info.Name != claims.Subject {
+		t.Fatalf("unexpected result for the old key: %+v, %v, %v", info, ok, err)
+	}
+
+	// tokens of a new key are verified once the keys are fetched again, no more often than keySetMinRefresh
+	published = []testKey{old, rotated}
+	keys.fetched = time.Now().Add(-keySetMinRefresh)
+	info, ok, err = s.AuthenticateToken(context.Background(), rotated.sign(t, claims, serviceAccountClaimsOf("sa", "uid-1")))
+	if err != nil || !ok || info.Name != claims.Subject {
+		t.Errorf("unexpected result for the rotated key: %+v, %v, %v", info, ok, err)
+	}
+
+	// removed keys are no longer trusted once the keys are fetched again
+	published = []testKey{rotated}
+	keys.fetched = time.Now().Add(-keySetMaxAge)
+	info, _, err = s.AuthenticateToken(context.Background(), old.sign(t, claims, serviceAccountClaimsOf("sa", "uid-1")))
+	if err != nil || info.Name != "fallback" {
+		t.Errorf("expected the token of the removed key to be left to the fallback, got %+v, %v", info, err)
+	}
+}
+
+func TestServiceAccountTokenCacheError(t *testing.T) {
+	key := newTestKey(t, "kid")
+	published := []testKey{key}
+	reader := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(context.Context, client.WithWatch, client.ObjectKey, client.Object, ...client.GetOption) error {
+			return errors.New("cache not synced")
+		},
+	}).Build()
+	s := NewServiceAccountToken(testKeySet(&published), nil, reader, fallbackToken{})
+	claims := jwt.Claims{Issuer: testIssuer, Subject: "system:serviceaccount:default:sa", Audience: jwt.Audience{testIssuer}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	// the token may well be valid, failing to read its ServiceAccount is not a failed authentication
+	_, ok, err := s.AuthenticateToken(context.Background(), key.sign(t, claims, serviceAccountClaimsOf("sa", "uid-1")))
+	if ok || !apierrors.IsInternalError(err) {
+		t.Errorf("expected an internal error, got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,58 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StaticTokens authenticates the tokens of a CSV file in the format of the apiserver's --token-auth-file:
+// token,user,uid,"group1,group2".
+type StaticTokens struct {
+	tokens map[string]*Info
+}
+
+func NewStaticTokensFromFile(path string) (*StaticTokens, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := map[string]*Info{}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s:%d: want token,user,uid[,groups], got %d columns", path, line, len(record))
+		}
+		token, info := record[0], &Info{Name: record[1], UID: record[2]}
+		if token == "" || info.Name == "" {
+			return nil, fmt.Errorf("%s:%d: token and user must be set", path, line)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, line)
+		}
+		if len(record) > 3 && record[3] != "" {
+			info.Groups = strings.Split(record[3], ",")
+		}
+		tokens[token] = info
+	}
+	return &StaticTokens{tokens: tokens}, nil
+}
+
+func (s *StaticTokens) AuthenticateToken(ctx context.Context, token string) (*Info, bool, error) {
+	info, ok := s.tokens[token]
+	return info, ok, nil
+}
@@ -0,0 +1,69 @@
+package authenticator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTokenFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "tokens.csv")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStaticTokens(t *testing.T) {
+	path := writeTokenFile(t, strings.Join([]string{
+		`token1,alice,1,"dev,ops"`,
+		`token2, bob, 2`,
+		`token3,"carol, jr",3,`,
+		`token4,dave,4,single`,
+	}, "\n"))
+	tokens, err := NewStaticTokensFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		token  string
+		name   string
+		uid    string
+		groups []string
+	}{
+		{"token1", "alice", "1", []string{"dev", "ops"}},
+		{"token2", "bob", "2", nil},
+		{"token3", "carol, jr", "3", nil},
+		{"token4", "dave", "4", []string{"single"}},
+	} {
+		info, ok, err := tokens.AuthenticateToken(context.Background(), tc.token)
+		if err != nil || !ok {
+			t.Errorf("%s was not authenticated: %v", tc.token, err)
+			continue
+		}
+		if info.Name != tc.name || info.UID != tc.uid || !slices.Equal(info.Groups, tc.groups) {
+			t.Errorf("%s authenticated as %+v", tc.token, info)
+		}
+	}
+	if _, ok, _ := tokens.AuthenticateToken(context.Background(), "unknown"); ok {
+		t.Error("an unknown token was authenticated")
+	}
+}
+
+func TestStaticTokensInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"too few columns": "token1,alice\n",
+		"no token":        ",alice,1\n",
+		"no user":         "token1,,1\n",
+		"duplicate token": "token1,alice,1\ntoken1,bob,2\n",
+		"bad quoting":     "token1,\"alice,1\n",
+	} {
+		if _, err := NewStaticTokensFromFile(writeTokenFile(t, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package authenticator
+
+import (
+	"context"
+
+	authv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TokenReview authenticates tokens with a TokenReview against the apiserver.
+type TokenReview struct {
+	client client.Client
+}
+
+func NewTokenReview(c client.Client) *TokenReview {
+	return &TokenReview{client: c}
+}
+
+func (t *TokenReview) AuthenticateToken(ctx context.Context, token string) (*Info, bool, error) {
+	tr := &authv1.TokenReview{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "tokenreview",
+		},
+		Spec: authv1.TokenReviewSpec{
+			Token: token,
+		},
+	}
+
+	err := t.client.Create(ctx, tr)
+	if err != nil {
+		return nil, false, apierrors.NewInternalError(err)
+	}
+	if !tr.Status.Authenticated {
+		return nil, false, nil
+	}
+	reviewed := tr.Status.User
+	info := &Info{Name: reviewed.Username, UID: reviewed.UID, Groups: reviewed.Groups}
+	if len(reviewed.Extra) != 0 {
+		info.Extra = make(map[string][]string, len(reviewed.Extra))
+		for k, v := range reviewed.Extra {
+			info.Extra[k] = v
+		}
+	}
+	return info, true, nil
+}
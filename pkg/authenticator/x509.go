@@ -0,0 +1,52 @@
+package authenticator
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// X509 authenticates TLS client certificates signed by a CA of roots, as the common name
+// in the groups of the organizations, like the apiserver does.
+type X509 struct {
+	roots *x509.CertPool
+}
+
+// NewX509FromFile reads the PEM encoded CAs of path.
+func NewX509FromFile(path string) (*X509, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return &X509{roots: roots}, nil
+}
+
+func (x *X509) AuthenticateRequest(req *http.Request) (*Info, bool, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, false, nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	cert := req.TLS.PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         x.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, false, apierrors.NewUnauthorized(fmt.Sprintf("verify client certificate: %v", err))
+	}
+	if cert.Subject.CommonName == "" {
+		return nil, false, apierrors.NewUnauthorized("client certificate has no common name")
+	}
+	return &Info{Name: cert.Subject.CommonName, Groups: append([]string{}, cert.Subject.Organization...)}, true, nil
+}
@@ -0,0 +1,124 @@
+package authenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a certificate for subject with the given extended key usage.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, usage x509.ExtKeyUsage) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) authenticator(t *testing.T) *X509 {
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	x, err := NewX509FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func requestWithCert(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return req
+}
+
+func TestX509(t *testing.T) {
+	ca, untrusted := newTestCA(t), newTestCA(t)
+	x := ca.authenticator(t)
+
+	info, ok, err := x.AuthenticateRequest(requestWithCert(ca.issue(t, pkix.Name{CommonName: "alice", Organization: []string{"dev", "ops"}}, x509.ExtKeyUsageClientAuth)))
+	if err != nil || !ok {
+		t.Fatalf("the client certificate was not authenticated: %v", err)
+	}
+	if info.Name != "alice" || !slices.Equal(info.Groups, []string{"dev", "ops"}) {
+		t.Errorf("unexpected identity %+v", info)
+	}
+
+	if _, ok, err := x.AuthenticateRequest(requestWithCert(nil)); ok || err != nil {
+		t.Errorf("a request without a certificate was authenticated: %v, %v", ok, err)
+	}
+
+	for name, cert := range map[string]*x509.Certificate{
+		"untrusted CA":       untrusted.issue(t, pkix.Name{CommonName: "alice"}, x509.ExtKeyUsageClientAuth),
+		"server certificate": ca.issue(t, pkix.Name{CommonName: "alice"}, x509.ExtKeyUsageServerAuth),
+		"no common name":     ca.issue(t, pkix.Name{Organization: []string{"dev"}}, x509.ExtKeyUsageClientAuth),
+	} {
+		_, ok, err := x.AuthenticateRequest(requestWithCert(cert))
+		if ok || !apierrors.IsUnauthorized(err) {
+			t.Errorf("%s: expected unauthorized, got %v, %v", name, ok, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	apiPrefixes                = map[string]bool{"api": true, "apis": true}
+	grouplessAPIPrefixes       = map[string]bool{"api": true}
+	specialVerbs               = map[string]bool{"proxy": true, "watch": true}
+	specialVerbsNoSubresources = map[string]bool{"proxy": true}
+	namespaceSubresources      = map[string]bool{"status": true, "finalize": true}
+)
+
+// Attributes describes a request the same way the apiserver's RequestInfo does.
+type Attributes struct {
+	User *auth.UserInfo
+
+	ResourceRequest bool
+	Path            string
+	Verb            string
+
+	APIGroup    string
+	APIVersion  string
+	Namespace   string
+	Resource    string
+	Subresource string
+	Name        string
+}
+
+// NewAttributes parses the request path and method following the rules of the apiserver:
+//
+//	/api/{version}/namespaces/{namespace}/{resource}/{name}/{subresource}
+//	/apis/{group}/{version}/{resource}/{name}/{subresource}
+//	/apis/{group}/{version}/watch/{resource}
+//
+// Anything else is a non-resource request whose verb is the lowercase HTTP method.
+func NewAttributes(req *http.Request) *Attributes {
+	attrs := &Attributes{Path: req.URL.Path, Verb: strings.ToLower(req.Method)}
+
+	parts := splitPath(req.URL.Path)
+	if len(parts) < 3 || !apiPrefixes[parts[0]] {
+		return attrs
+	}
+	prefix := parts[0]
+	parts = parts[1:]
+
+	if !grouplessAPIPrefixes[prefix] {
+		if len(parts) < 3 {
+			return attrs
+		}
+		attrs.APIGroup = parts[0]
+		parts = parts[1:]
+	}
+
+	attrs.ResourceRequest = true
+	attrs.APIVersion = parts[0]
+	parts = parts[1:]
+
+	if specialVerbs[parts[0]] {
+		if len(parts) < 2 {
+			attrs.ResourceRequest = false
+			return attrs
+		}
+		attrs.Verb = parts[0]
+		parts = parts[1:]
+	} else {
+		switch req.Method {
+		case http.MethodPost:
+			attrs.Verb = "create"
+		case http.MethodGet, http.MethodHead:
+			attrs.Verb = "get"
+		case http.MethodPut:
+			attrs.Verb = "update"
+		case http.MethodPatch:
+			attrs.Verb = "patch"
+		case http.MethodDelete:
+			attrs.Verb = "delete"
+		default:
+			attrs.Verb = ""
+		}
+	}
+
+	if parts[0] == "namespaces" {
+		if len(parts) > 1 {
+			attrs.Namespace = parts[1]
+			if len(parts) > 2 && !namespaceSubresources[parts[2]] {
+				parts = parts[2:]
+			}
+		}
+	}
+
+	// parts look like: resource/name/subresource/other/stuff
+	switch {
+	case len(parts) >= 3 && !specialVerbsNoSubresources[attrs.Verb]:
+		attrs.Subresource = parts[2]
+		fallthrough
+	case len(parts) >= 2:
+		attrs.Name = parts[1]
+		fallthrough
+	case len(parts) >= 1:
+		attrs.Resource = parts[0]
+	}
+
+	if attrs.Name == "" && attrs.Verb == "get" {
+		attrs.Verb = "list"
+		if http_common.IsWatch(req) {
+			attrs.Verb = "watch"
+		}
+		// a list or watch restricted to a single object is authorized against that object's name
+		if selector, err := fields.ParseSelector(req.URL.Query().Get("fieldSelector")); err == nil {
+			if name, ok := selector.RequiresExactMatch("metadata.name"); ok && len(path.IsValidPathSegmentName(name)) == 0 {
+				attrs.Name = name
+			}
+		}
+	}
+	if attrs.Name == "" && attrs.Verb == "delete" {
+		attrs.Verb = "deletecollection"
+	}
+
+	return attrs
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// Forbidden returns the error the apiserver responds with when the request is denied.
+func Forbidden(attrs *Attributes) error {
+	var msg string
+	resource := attrs.Resource
+	if attrs.Subresource != "" {
+		resource = resource + "/" + attrs.Subresource
+	}
+	switch {
+	case !attrs.ResourceRequest:
+		msg = fmt.Sprintf("User %q cannot %s path %q", attrs.User.Username, attrs.Verb, attrs.Path)
+	case attrs.Namespace != "":
+		msg = fmt.Sprintf("User %q cannot %s resource %q in API group %q in the namespace %q", attrs.User.Username, attrs.Verb, resource, attrs.APIGroup, attrs.Namespace)
+	default:
+		msg = fmt.Sprintf("User %q cannot %s resource %q in API group %q at the cluster scope", attrs.User.Username, attrs.Verb, resource, attrs.APIGroup)
+	}
+	return apierrors.NewForbidden(schema.GroupResource{Group: attrs.APIGroup, Resource: resource}, attrs.Name, errors.New(msg))
+}
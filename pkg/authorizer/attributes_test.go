@@ -0,0 +1,82 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestNewAttributesMatchesUpstream(t *testing.T) {
+	factory := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	tests := []struct {
+		method string
+		url    string
+	}{
+		{http.MethodGet, "/api/v1/pods"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods/a"},
+		{http.MethodHead, "/api/v1/namespaces/default/pods/a"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods/a/log"},
+		{http.MethodPost, "/api/v1/namespaces/default/pods/a/eviction"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods/a/log/extra/parts"},
+		{http.MethodPost, "/api/v1/namespaces/default/pods"},
+		{http.MethodPut, "/api/v1/namespaces/default/configmaps/x"},
+		{http.MethodPatch, "/api/v1/namespaces/default/configmaps/x"},
+		{http.MethodDelete, "/api/v1/namespaces/default/configmaps/x"},
+		{http.MethodDelete, "/api/v1/namespaces/default/configmaps"},
+		{http.MethodOptions, "/api/v1/namespaces/default/configmaps"},
+		{http.MethodGet, "/api/v1/namespaces"},
+		{http.MethodGet, "/api/v1/namespaces/default"},
+		{http.MethodPut, "/api/v1/namespaces/default/status"},
+		{http.MethodPut, "/api/v1/namespaces/default/finalize"},
+		{http.MethodGet, "/api/v1/nodes/n/status"},
+		{http.MethodGet, "/apis/apps/v1/deployments"},
+		{http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/d"},
+		{http.MethodPut, "/apis/apps/v1/namespaces/default/deployments/d/scale"},
+		{http.MethodGet, "/apis/apps/v1/watch/deployments"},
+		{http.MethodGet, "/apis/apps/v1/watch/namespaces/default/deployments/d"},
+		{http.MethodGet, "/api/v1/proxy/namespaces/default/pods/a/some/path"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=true"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=1"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=yes"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=false"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=0"},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%3Dx"},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%3Dx&watch=true"},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%3D.."},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%3Da%25b"},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%21%3Dx"},
+		{http.MethodGet, "/api/v1/namespaces/default/configmaps?fieldSelector=metadata.name%3Dx,metadata.namespace%3Ddefault"},
+		{http.MethodGet, "/api"},
+		{http.MethodGet, "/api/v1"},
+		{http.MethodGet, "/apis"},
+		{http.MethodGet, "/apis/apps"},
+		{http.MethodGet, "/apis/apps/v1"},
+		{http.MethodGet, "/healthz"},
+		{http.MethodPost, "/healthz/ping"},
+		{http.MethodGet, "/version"},
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/openapi/v2"},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.url, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.url, nil)
+			want, err := factory.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := NewAttributes(req)
+			if got.ResourceRequest != want.IsResourceRequest || got.Path != want.Path || got.Verb != want.Verb ||
+				got.APIGroup != want.APIGroup || got.APIVersion != want.APIVersion || got.Namespace != want.Namespace ||
+				got.Resource != want.Resource || got.Subresource != want.Subresource || got.Name != want.Name {
+				t.Errorf("NewAttributes = %+v, upstream = %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package authorizer
+
+import (
+	"context"
+)
+
+// Authorizer decides whether the user in attrs may perform the request.
+type Authorizer interface {
+	Authorize(ctx context.Context, attrs *Attributes) (bool, error)
+}
+
+// ContextKey is where the attributes of the authorized request are kept in the gin context.
+const ContextKey = "attributes"
+
+// Invalidator is implemented by authorizers caching their decisions.
+type Invalidator interface {
+	Invalidate()
+}
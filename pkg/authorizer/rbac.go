@@ -0,0 +1,173 @@
+package authorizer
+
+import (
+	"context"
+	"slices"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SubjectIndex is the field index registered on RoleBindings and ClusterRoleBindings for their subjects,
+// see SubjectIndexFunc for the format of the indexed values.
+const SubjectIndex = ".subjects[*]"
+
+// SubjectIndexFunc indexes every subject of a binding as "kind/namespace/name". ServiceAccount subjects
+// without a namespace in a RoleBinding default to the RoleBinding's namespace, like the apiserver does.
+func SubjectIndexFunc(rawObj client.Object) []string {
+	var subjects []rbacv1.Subject
+	switch binding := rawObj.(type) {
+	case *rbacv1.RoleBinding:
+		subjects = binding.Subjects
+	case *rbacv1.ClusterRoleBinding:
+		subjects = binding.Subjects
+	}
+
+	keys := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		switch subject.Kind {
+		case rbacv1.ServiceAccountKind:
+			namespace := subject.Namespace
+			if namespace == "" {
+				namespace = rawObj.GetNamespace()
+			}
+			keys = append(keys, subjectKey(rbacv1.ServiceAccountKind, namespace, subject.Name))
+		case rbacv1.UserKind, rbacv1.GroupKind:
+			keys = append(keys, subjectKey(subject.Kind, "", subject.Name))
+		}
+	}
+	return keys
+}
+
+func subjectKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// subjectKeys returns the index values of every subject the user matches: its user name, its groups
+// and, for ServiceAccounts, the ServiceAccount itself.
+func subjectKeys(user *auth.UserInfo) []string {
+	keys := make([]string, 0, len(user.Groups)+2)
+	keys = append(keys, subjectKey(rbacv1.UserKind, "", user.Username))
+	for _, group := range user.Groups {
+		keys = append(keys, subjectKey(rbacv1.GroupKind, "", group))
+	}
+	if namespace, name, ok := auth.ParseServiceAccountUsername(user.Username); ok {
+		keys = append(keys, subjectKey(rbacv1.ServiceAccountKind, namespace, name))
+	}
+	return keys
+}
+
+// RBACAuthorizer evaluates the RoleBindings and ClusterRoleBindings of the user from the manager's cache.
+type RBACAuthorizer struct {
+	client client.Reader
+}
+
+func NewRBACAuthorizer(c client.Reader) *RBACAuthorizer {
+	return &RBACAuthorizer{client: c}
+}
+
+func (r *RBACAuthorizer) Authorize(ctx context.Context, attrs *Attributes) (bool, error) {
+	keys := subjectKeys(attrs.User)
+
+	clusterRoleBindings := map[string]rbacv1.ClusterRoleBinding{}
+	for _, key := range keys {
+		clusterRoleBindingList := &rbacv1.ClusterRoleBindingList{}
+		err := r.client.List(ctx, clusterRoleBindingList, &client.ListOptions{FieldSelector: fields.OneTermEqualSelector(SubjectIndex, key)})
+		if err != nil {
+			return false, err
+		}
+		for _, clusterRoleBinding := range clusterRoleBindingList.Items {
+			clusterRoleBindings[clusterRoleBinding.Name] = clusterRoleBinding
+		}
+	}
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		rules, err := r.clusterRoleRules(ctx, clusterRoleBinding.RoleRef.Name)
+		if err != nil {
+			return false, err
+		}
+		if RulesAllow(attrs, rules...) {
+			return true, nil
+		}
+	}
+
+	// RoleBindings only grant access inside their own namespace, and only in the namespaces of the user;
+	// users without a home namespace, e.g. of client certificates, are bound in any namespace as upstream
+	if attrs.Namespace == "" || (attrs.User.Namespace != "" && !slices.Contains(attrs.User.Namespaces, attrs.Namespace)) {
+		return false, nil
+	}
+	roleBindings := map[string]rbacv1.RoleBinding{}
+	for _, key := range keys {
+		roleBindingList := &rbacv1.RoleBindingList{}
+		err := r.client.List(ctx, roleBindingList, &client.ListOptions{FieldSelector: fields.OneTermEqualSelector(SubjectIndex, key), Namespace: attrs.Namespace})
+		if err != nil {
+			return false, err
+		}
+		for _, roleBinding := range roleBindingList.Items {
+			roleBindings[roleBinding.Name] = roleBinding
+		}
+	}
+	for _, roleBinding := range roleBindings {
+		var (
+			rules []rbacv1.PolicyRule
+			err   error
+		)
+		if roleBinding.RoleRef.Kind == "ClusterRole" {
+			rules, err = r.clusterRoleRules(ctx, roleBinding.RoleRef.Name)
+		} else {
+			rules, err = r.roleRules(ctx, roleBinding.Namespace, roleBinding.RoleRef.Name)
+		}
+		if err != nil {
+			return false, err
+		}
+		if RulesAllow(attrs, rules...) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *RBACAuthorizer) roleRules(ctx context.Context, namespace, name string) ([]rbacv1.PolicyRule, error) {
+	role := &rbacv1.Role{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, role)
+	if err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return role.Rules, nil
+}
+
+// clusterRoleRules returns the rules of the ClusterRole, including the rules of the ClusterRoles
+// selected by its aggregationRule in case the aggregation controller has not caught up yet.
+func (r *RBACAuthorizer) clusterRoleRules(ctx context.Context, name string) ([]rbacv1.PolicyRule, error) {
+	clusterRole := &rbacv1.ClusterRole{}
+	err := r.client.Get(ctx, types.NamespacedName{Name: name}, clusterRole)
+	if err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	rules := clusterRole.Rules
+	if clusterRole.AggregationRule == nil {
+		return rules, nil
+	}
+
+	for i := range clusterRole.AggregationRule.ClusterRoleSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(&clusterRole.AggregationRule.ClusterRoleSelectors[i])
+		if err != nil {
+			return nil, err
+		}
+		clusterRoleList := &rbacv1.ClusterRoleList{}
+		err = r.client.List(ctx, clusterRoleList, client.MatchingLabelsSelector{Selector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, aggregated := range clusterRoleList.Items {
+			if aggregated.Name == name {
+				continue
+			}
+			rules = append(rules, aggregated.Rules...)
+		}
+	}
+	return rules, nil
+}
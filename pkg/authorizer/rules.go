@@ -0,0 +1,95 @@
+package authorizer
+
+import (
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// RuleAllows reports whether rule grants the request, with the semantics of the upstream RBAC authorizer.
+func RuleAllows(attrs *Attributes, rule *rbacv1.PolicyRule) bool {
+	if attrs.ResourceRequest {
+		combinedResource := attrs.Resource
+		if attrs.Subresource != "" {
+			combinedResource = attrs.Resource + "/" + attrs.Subresource
+		}
+		return VerbMatches(rule, attrs.Verb) &&
+			APIGroupMatches(rule, attrs.APIGroup) &&
+			ResourceMatches(rule, combinedResource, attrs.Subresource) &&
+			ResourceNameMatches(rule, attrs.Name)
+	}
+	return VerbMatches(rule, attrs.Verb) &&
+		NonResourceURLMatches(rule, attrs.Path)
+}
+
+// RulesAllow reports whether any of rules grants the request.
+func RulesAllow(attrs *Attributes, rules ...rbacv1.PolicyRule) bool {
+	for i := range rules {
+		if RuleAllows(attrs, &rules[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func VerbMatches(rule *rbacv1.PolicyRule, requestedVerb string) bool {
+	for _, verb := range rule.Verbs {
+		if verb == rbacv1.VerbAll || verb == requestedVerb {
+			return true
+		}
+	}
+	return false
+}
+
+func APIGroupMatches(rule *rbacv1.PolicyRule, requestedGroup string) bool {
+	for _, group := range rule.APIGroups {
+		if group == rbacv1.APIGroupAll || group == requestedGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourceMatches matches "*", the exact "resource" or "resource/subresource", and "*/subresource".
+func ResourceMatches(rule *rbacv1.PolicyRule, combinedRequestedResource, requestedSubresource string) bool {
+	for _, resource := range rule.Resources {
+		if resource == rbacv1.ResourceAll || resource == combinedRequestedResource {
+			return true
+		}
+		if requestedSubresource == "" {
+			continue
+		}
+		if len(resource) == len(requestedSubresource)+2 &&
+			strings.HasPrefix(resource, "*/") &&
+			strings.HasSuffix(resource, requestedSubresource) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourceNameMatches allows any name when the rule has no resourceNames.
+func ResourceNameMatches(rule *rbacv1.PolicyRule, requestedName string) bool {
+	if len(rule.ResourceNames) == 0 {
+		return true
+	}
+	for _, name := range rule.ResourceNames {
+		if name == requestedName {
+			return true
+		}
+	}
+	return false
+}
+
+// NonResourceURLMatches matches "*", the exact path, and prefixes ending with "*".
+func NonResourceURLMatches(rule *rbacv1.PolicyRule, requestedURL string) bool {
+	for _, url := range rule.NonResourceURLs {
+		if url == rbacv1.NonResourceAll || url == requestedURL {
+			return true
+		}
+		if strings.HasSuffix(url, "*") && strings.HasPrefix(requestedURL, strings.TrimRight(url, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package authorizer
+
+import (
+	"fmt"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/component-helpers/auth/rbac/validation"
+)
+
+// upstreamAllows asks the RBAC policy comparator of upstream whether rule covers the single permission
+// the request needs, which is how the RBAC authorizer decides.
+func upstreamAllows(attrs *Attributes, rule rbacv1.PolicyRule) bool {
+	requested := rbacv1.PolicyRule{Verbs: []string{attrs.Verb}}
+	if attrs.ResourceRequest {
+		resource := attrs.Resource
+		if attrs.Subresource != "" {
+			resource += "/" + attrs.Subresource
+		}
+		requested.APIGroups = []string{attrs.APIGroup}
+		requested.Resources = []string{resource}
+		if attrs.Name != "" {
+			requested.ResourceNames = []string{attrs.Name}
+		}
+	} else {
+		requested.NonResourceURLs = []string{attrs.Path}
+	}
+	covers, _ := validation.Covers([]rbacv1.PolicyRule{rule}, []rbacv1.PolicyRule{requested})
+	return covers
+}
+
+func TestRuleAllowsMatchesUpstream(t *testing.T) {
+	rules := []rbacv1.PolicyRule{
+		{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		{Verbs: []string{"get", "list", "watch"}, APIGroups: []string{"", "apps"}, Resources: []string{"pods", "deployments"}},
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods/log"}},
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"*/status"}},
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods/*"}},
+		{Verbs: []string{"update"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"x"}},
+		{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"x", "y"}},
+		{Verbs: []string{"*"}, APIGroups: []string{"apps"}, Resources: []string{"*"}},
+		{Verbs: []string{"get"}, NonResourceURLs: []string{"*"}},
+		{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz"}},
+		{Verbs: []string{"get", "post"}, NonResourceURLs: []string{"/apis/*"}},
+		{Verbs: []string{"get"}, NonResourceURLs: []string{"/version/*"}},
+		{Verbs: []string{"*"}, NonResourceURLs: []string{"/metrics"}},
+	}
+	requests := []*Attributes{
+		{ResourceRequest: true, Verb: "get", Resource: "pods", Name: "a", Namespace: "default"},
+		{ResourceRequest: true, Verb: "list", Resource: "pods", Namespace: "default"},
+		{ResourceRequest: true, Verb: "watch", APIGroup: "apps", Resource: "deployments"},
+		{ResourceRequest: true, Verb: "delete", APIGroup: "apps", Resource: "deployments", Name: "d"},
+		{ResourceRequest: true, Verb: "get", Resource: "pods", Subresource: "log", Name: "a"},
+		{ResourceRequest: true, Verb: "get", Resource: "pods", Subresource: "status", Name: "a"},
+		{ResourceRequest: true, Verb: "get", Resource: "nodes", Subresource: "status", Name: "n"},
+		{ResourceRequest: true, Verb: "get", APIGroup: "apps", Resource: "deployments", Subresource: "status", Name: "d"},
+		{ResourceRequest: true, Verb: "update", Resource: "configmaps", Name: "x"},
+		{ResourceRequest: true, Verb: "update", Resource: "configmaps", Name: "y"},
+		{ResourceRequest: true, Verb: "get", Resource: "configmaps", Name: "y"},
+		{ResourceRequest: true, Verb: "list", Resource: "configmaps"},
+		{ResourceRequest: true, Verb: "list", Resource: "configmaps", Name: "x"},
+		{ResourceRequest: true, Verb: "deletecollection", Resource: "configmaps"},
+		{ResourceRequest: true, Verb: "get", APIGroup: "batch", Resource: "jobs", Name: "j"},
+		{Verb: "get", Path: "/healthz"},
+		{Verb: "get", Path: "/healthz/ping"},
+		{Verb: "get", Path: "/apis"},
+		{Verb: "get", Path: "/apis/"},
+		{Verb: "post", Path: "/apis/apps"},
+		{Verb: "get", Path: "/version"},
+		{Verb: "get", Path: "/version/"},
+		{Verb: "put", Path: "/metrics"},
+		{Verb: "get", Path: "/metrics/cadvisor"},
+	}
+
+	for i, rule := range rules {
+		for _, attrs := range requests {
+			t.Run(fmt.Sprintf("rule %d %s", i, describe(attrs)), func(t *testing.T) {
+				if got, want := RuleAllows(attrs, &rule), upstreamAllows(attrs, rule); got != want {
+					t.Errorf("RuleAllows = %v, upstream = %v for rule %+v", got, want, rule)
+				}
+			})
+		}
+	}
+}
+
+func TestRulesAllow(t *testing.T) {
+	rules := []rbacv1.PolicyRule{
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"services"}},
+	}
+	tests := []struct {
+		attrs *Attributes
+		want  bool
+	}{
+		{&Attributes{ResourceRequest: true, Verb: "get", Resource: "pods", Name: "a"}, true},
+		{&Attributes{ResourceRequest: true, Verb: "list", Resource: "services"}, true},
+		{&Attributes{ResourceRequest: true, Verb: "list", Resource: "pods"}, false},
+		{&Attributes{ResourceRequest: true, Verb: "get", Resource: "pods", Subresource: "log", Name: "a"}, false},
+	}
+	for _, test := range tests {
+		t.Run(describe(test.attrs), func(t *testing.T) {
+			if got := RulesAllow(test.attrs, rules...); got != test.want {
+				t.Errorf("RulesAllow = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func describe(attrs *Attributes) string {
+	if !attrs.ResourceRequest {
+		return attrs.Verb + " " + attrs.Path
+	}
+	return fmt.Sprintf("%s %s/%s/%s/%s", attrs.Verb, attrs.APIGroup, attrs.Resource, attrs.Subresource, attrs.Name)
+}
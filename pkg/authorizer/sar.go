@@ -0,0 +1,158 @@
+package authorizer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type sarKey struct {
+	user        string
+	uid         string
+	groups      string
+	extra       string
+	verb        string
+	group       string
+	version     string
+	resource    string
+	subresource string
+	namespace   string
+	name        string
+	path        string
+}
+
+type sarDecision struct {
+	allowed bool
+	expire  time.Time
+}
+
+// SubjectAccessReviewAuthorizer delegates every decision to the apiserver with a SubjectAccessReview,
+// so webhook, ABAC and any other authorizer configured there are honored.
+// Decisions are cached for ttl, keyed by the user and the request attributes.
+type SubjectAccessReviewAuthorizer struct {
+	client client.Client
+	ttl    time.Duration
+
+	cache     sync.Map
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewSubjectAccessReviewAuthorizer(c client.Client, ttl time.Duration) *SubjectAccessReviewAuthorizer {
+	return &SubjectAccessReviewAuthorizer{client: c, ttl: ttl, lastSweep: time.Now()}
+}
+
+func (s *SubjectAccessReviewAuthorizer) Authorize(ctx context.Context, attrs *Attributes) (bool, error) {
+	key := sarKey{
+		user:        attrs.User.Username,
+		uid:         attrs.User.UID,
+		groups:      strings.Join(attrs.User.Groups, "\x00"),
+		extra:       extraKey(attrs.User.Extra),
+		verb:        attrs.Verb,
+		group:       attrs.APIGroup,
+		version:     attrs.APIVersion,
+		resource:    attrs.Resource,
+		subresource: attrs.Subresource,
+		namespace:   attrs.Namespace,
+		name:        attrs.Name,
+	}
+	if !attrs.ResourceRequest {
+		key.path = attrs.Path
+	}
+
+	now := time.Now()
+	if cached, ok := s.cache.Load(key); ok {
+		if decision := cached.(*sarDecision); decision.expire.After(now) {
+			return decision.allowed, nil
+		}
+		s.cache.Delete(key)
+	}
+
+	sar := &authzv1.SubjectAccessReview{
+		Spec: authzv1.SubjectAccessReviewSpec{
+			User:   attrs.User.Username,
+			UID:    attrs.User.UID,
+			Groups: attrs.User.Groups,
+		},
+	}
+	if len(attrs.User.Extra) > 0 {
+		sar.Spec.Extra = make(map[string]authzv1.ExtraValue, len(attrs.User.Extra))
+		for k, v := range attrs.User.Extra {
+			sar.Spec.Extra[k] = v
+		}
+	}
+	if attrs.ResourceRequest {
+		sar.Spec.ResourceAttributes = &authzv1.ResourceAttributes{
+			Namespace:   attrs.Namespace,
+			Verb:        attrs.Verb,
+			Group:       attrs.APIGroup,
+			Version:     attrs.APIVersion,
+			Resource:    attrs.Resource,
+			Subresource: attrs.Subresource,
+			Name:        attrs.Name,
+		}
+	} else {
+		sar.Spec.NonResourceAttributes = &authzv1.NonResourceAttributes{
+			Path: attrs.Path,
+			Verb: attrs.Verb,
+		}
+	}
+
+	err := s.client.Create(ctx, sar)
+	if err != nil {
+		return false, err
+	}
+
+	s.cache.Store(key, &sarDecision{allowed: sar.Status.Allowed, expire: now.Add(s.ttl)})
+	s.sweep(now)
+	return sar.Status.Allowed, nil
+}
+
+func extraKey(extra map[string][]string) string {
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	for _, k := range keys {
+		b.WriteString(k)
+		for _, v := range extra[k] {
+			b.WriteString("\x00")
+			b.WriteString(v)
+		}
+		b.WriteString("\x01")
+	}
+	return b.String()
+}
+
+// sweep drops expired decisions at most once per ttl.
+func (s *SubjectAccessReviewAuthorizer) sweep(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < s.ttl {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+
+	s.cache.Range(func(key, value any) bool {
+		if value.(*sarDecision).expire.Before(now) {
+			s.cache.Delete(key)
+		}
+		return true
+	})
+}
+
+// Invalidate drops every cached decision, RBAC changes take effect on the next review.
+func (s *SubjectAccessReviewAuthorizer) Invalidate() {
+	s.cache.Range(func(key, value any) bool {
+		s.cache.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,243 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// fakeReviews answers SubjectAccessReviews with allow and records their specs.
+type fakeReviews struct {
+	allow func(spec authzv1.SubjectAccessReviewSpec) bool
+	err   error
+
+	mu    sync.Mutex
+	specs []authzv1.SubjectAccessReviewSpec
+}
+
+func (f *fakeReviews) client() client.Client {
+	return fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			sar := obj.(*authzv1.SubjectAccessReview)
+			f.mu.Lock()
+			f.specs = append(f.specs, sar.Spec)
+			f.mu.Unlock()
+			if f.err != nil {
+				return f.err
+			}
+			sar.Status.Allowed = f.allow(sar.Spec)
+			return nil
+		},
+	}).Build()
+}
+
+func (f *fakeReviews) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.specs)
+}
+
+func allowAll(authzv1.SubjectAccessReviewSpec) bool { return true }
+
+func podAttributes() *Attributes {
+	return &Attributes{
+		User:            &auth.UserInfo{Username: "alice", UID: "1", Groups: []string{"dev", "system:authenticated"}},
+		ResourceRequest: true,
+		Verb:            "get",
+		APIVersion:      "v1",
+		Namespace:       "default",
+		Resource:        "pods",
+		Name:            "a",
+	}
+}
+
+func TestSubjectAccessReviewMapping(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs *Attributes
+		want  authzv1.SubjectAccessReviewSpec
+	}{
+		{
+			name: "resource",
+			attrs: &Attributes{
+				User:            &auth.UserInfo{Username: "alice", UID: "1", Groups: []string{"dev"}, Extra: map[string][]string{"scopes": {"a", "b"}}},
+				ResourceRequest: true,
+				Verb:            "update",
+				APIGroup:        "apps",
+				APIVersion:      "v1",
+				Namespace:       "default",
+				Resource:        "deployments",
+				Subresource:     "scale",
+				Name:            "d",
+			},
+			want: authzv1.SubjectAccessReviewSpec{
+				User:   "alice",
+				UID:    "1",
+				Groups: []string{"dev"},
+				Extra:  map[string]authzv1.ExtraValue{"scopes": {"a", "b"}},
+				ResourceAttributes: &authzv1.ResourceAttributes{
+					Namespace: "default", Verb: "update", Group: "apps", Version: "v1", Resource: "deployments", Subresource: "scale", Name: "d",
+				},
+			},
+		},
+		{
+			name: "non-resource",
+			attrs: &Attributes{
+				User: &auth.UserInfo{Username: "alice"},
+				Verb: "get",
+				Path: "/healthz",
+			},
+			want: authzv1.SubjectAccessReviewSpec{
+				User:                  "alice",
+				NonResourceAttributes: &authzv1.NonResourceAttributes{Path: "/healthz", Verb: "get"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reviews := &fakeReviews{allow: allowAll}
+			s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+			if _, err := s.Authorize(context.Background(), test.attrs); err != nil {
+				t.Fatal(err)
+			}
+			if reviews.count() != 1 || !reflect.DeepEqual(reviews.specs[0], test.want) {
+				t.Errorf("reviewed %+v, want %+v", reviews.specs, test.want)
+			}
+		})
+	}
+}
+
+func TestSubjectAccessReviewDecision(t *testing.T) {
+	reviews := &fakeReviews{allow: func(spec authzv1.SubjectAccessReviewSpec) bool {
+		return spec.ResourceAttributes != nil && spec.ResourceAttributes.Verb == "get"
+	}}
+	s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+
+	allowed, err := s.Authorize(context.Background(), podAttributes())
+	if err != nil || !allowed {
+		t.Errorf("get = %v, %v, want allowed", allowed, err)
+	}
+	attrs := podAttributes()
+	attrs.Verb = "delete"
+	allowed, err = s.Authorize(context.Background(), attrs)
+	if err != nil || allowed {
+		t.Errorf("delete = %v, %v, want denied", allowed, err)
+	}
+}
+
+func TestSubjectAccessReviewCacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(attrs *Attributes)
+	}{
+		{"user", func(attrs *Attributes) {
+			attrs.User = &auth.UserInfo{Username: "bob", UID: "1", Groups: attrs.User.Groups}
+		}},
+		{"uid", func(attrs *Attributes) {
+			attrs.User = &auth.UserInfo{Username: "alice", UID: "2", Groups: attrs.User.Groups}
+		}},
+		{"groups", func(attrs *Attributes) {
+			attrs.User = &auth.UserInfo{Username: "alice", UID: "1", Groups: []string{"dev"}}
+		}},
+		{"extra", func(attrs *Attributes) {
+			attrs.User = &auth.UserInfo{Username: "alice", UID: "1", Groups: attrs.User.Groups, Extra: map[string][]string{"scopes": {"a"}}}
+		}},
+		{"verb", func(attrs *Attributes) { attrs.Verb = "update" }},
+		{"group", func(attrs *Attributes) { attrs.APIGroup = "metrics.k8s.io" }},
+		{"version", func(attrs *Attributes) { attrs.APIVersion = "v1beta1" }},
+		{"resource", func(attrs *Attributes) { attrs.Resource = "services" }},
+		{"subresource", func(attrs *Attributes) { attrs.Subresource = "log" }},
+		{"namespace", func(attrs *Attributes) { attrs.Namespace = "kube-system" }},
+		{"name", func(attrs *Attributes) { attrs.Name = "b" }},
+		{"non-resource path", func(attrs *Attributes) {
+			*attrs = Attributes{User: attrs.User, Verb: "get", Path: "/healthz"}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reviews := &fakeReviews{allow: allowAll}
+			s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+			for i := 0; i < 2; i++ {
+				if _, err := s.Authorize(context.Background(), podAttributes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if reviews.count() != 1 {
+				t.Fatalf("the same request was reviewed %d times", reviews.count())
+			}
+			attrs := podAttributes()
+			test.change(attrs)
+			if _, err := s.Authorize(context.Background(), attrs); err != nil {
+				t.Fatal(err)
+			}
+			if reviews.count() != 2 {
+				t.Errorf("a request of another %s was answered from the cache", test.name)
+			}
+		})
+	}
+
+	t.Run("non-resource paths", func(t *testing.T) {
+		reviews := &fakeReviews{allow: allowAll}
+		s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+		for _, path := range []string{"/healthz", "/metrics", "/healthz"} {
+			if _, err := s.Authorize(context.Background(), &Attributes{User: &auth.UserInfo{Username: "alice"}, Verb: "get", Path: path}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reviews.count() != 2 {
+			t.Errorf("reviewed %d times, want once per path", reviews.count())
+		}
+	})
+}
+
+func TestSubjectAccessReviewExpiry(t *testing.T) {
+	reviews := &fakeReviews{allow: allowAll}
+	s := NewSubjectAccessReviewAuthorizer(reviews.client(), 50*time.Millisecond)
+	if _, err := s.Authorize(context.Background(), podAttributes()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := s.Authorize(context.Background(), podAttributes()); err != nil {
+		t.Fatal(err)
+	}
+	if reviews.count() != 2 {
+		t.Errorf("an expired decision was used, reviewed %d times", reviews.count())
+	}
+}
+
+func TestSubjectAccessReviewInvalidate(t *testing.T) {
+	reviews := &fakeReviews{allow: allowAll}
+	s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+	if _, err := s.Authorize(context.Background(), podAttributes()); err != nil {
+		t.Fatal(err)
+	}
+	s.Invalidate()
+	if _, err := s.Authorize(context.Background(), podAttributes()); err != nil {
+		t.Fatal(err)
+	}
+	if reviews.count() != 2 {
+		t.Errorf("a decision survived Invalidate, reviewed %d times", reviews.count())
+	}
+}
+
+func TestSubjectAccessReviewError(t *testing.T) {
+	reviews := &fakeReviews{allow: allowAll, err: errors.New("apiserver unavailable")}
+	s := NewSubjectAccessReviewAuthorizer(reviews.client(), time.Minute)
+	if _, err := s.Authorize(context.Background(), podAttributes()); err == nil {
+		t.Fatal("expected the error of the review")
+	}
+	reviews.err = nil
+	allowed, err := s.Authorize(context.Background(), podAttributes())
+	if err != nil || !allowed || reviews.count() != 2 {
+		t.Errorf("a failed review was cached: %v, %v, reviewed %d times", allowed, err, reviews.count())
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// FieldIndex registers cache indexes on fields of a kind, so field selectors on them are answered by the index.
+type FieldIndex struct {
+	Group   string   `json:"group"`
+	Version string   `json:"version"`
+	Kind    string   `json:"kind"`
+	Fields  []string `json:"fields"`
+}
+
+func (f FieldIndex) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: f.Group, Version: f.Version, Kind: f.Kind}
+}
+
+// Any as Group or Kind of a CachedKind matches every group or kind.
+const Any = "*"
+
+// CachedKind allows reads and watches of a kind to be cached, all of its versions when Version is empty.
+type CachedKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version,omitempty"`
+	Kind    string `json:"kind"`
+}
+
+type Config struct {
+	// FieldIndexes are registered at startup, their informers run for good. Their kinds must be in CacheAllowlist.
+	FieldIndexes []FieldIndex `json:"fieldIndexes,omitempty"`
+	// CacheAllowlist are the kinds users may make the proxy cache, other kinds are always read from the apiserver
+	// and cannot be watched. Left out, no kind is cached; caching every kind, Secrets included, takes an explicit
+	// entry with group and kind "*".
+	CacheAllowlist []CachedKind `json:"cacheAllowlist,omitempty"`
+}
+
+// Load reads the YAML or JSON config at path, an empty path is an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	for _, index := range cfg.FieldIndexes {
+		if !cfg.cacheAllowed(index.GroupVersionKind()) {
+			return nil, fmt.Errorf("field index of %s: the kind is not in the cacheAllowlist", index.GroupVersionKind())
+		}
+	}
+	return cfg, nil
+}
+
+func (c *Config) cacheAllowed(gvk schema.GroupVersionKind) bool {
+	for _, kind := range c.CacheAllowlist {
+		if (kind.Group == Any || kind.Group == gvk.Group) && (kind.Kind == Any || kind.Kind == gvk.Kind) && (kind.Version == "" || kind.Version == gvk.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldIndexesByKind merges the configured field indexes per kind.
+func (c *Config) FieldIndexesByKind() map[schema.GroupVersionKind][]string {
+	indexes := map[schema.GroupVersionKind][]string{}
+	for _, index := range c.FieldIndexes {
+		gvk := index.GroupVersionKind()
+	next:
+		for _, field := range index.Fields {
+			for _, registered := range indexes[gvk] {
+				if registered == field {
+					continue next
+				}
+			}
+			indexes[gvk] = append(indexes[gvk], field)
+		}
+	}
+	return indexes
+}
+
+// CacheAllowlistKinds returns the kinds of CacheAllowlist, Any included.
+func (c *Config) CacheAllowlistKinds() []schema.GroupVersionKind {
+	kinds := make([]schema.GroupVersionKind, 0, len(c.CacheAllowlist))
+	for _, kind := range c.CacheAllowlist {
+		kinds = append(kinds, schema.GroupVersionKind{Group: kind.Group, Version: kind.Version, Kind: kind.Kind})
+	}
+	return kinds
+}
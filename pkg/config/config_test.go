@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// load loads a config file of data, no file if data is empty.
+func load(t *testing.T, data string) (*Config, error) {
+	if data == "" {
+		return Load("")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestCacheAllowlist(t *testing.T) {
+	secret := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	deployment := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+
+	for _, tc := range []struct {
+		name    string
+		config  string
+		allowed map[schema.GroupVersionKind]bool
+	}{
+		{"no config", "", map[schema.GroupVersionKind]bool{secret: false, deployment: false}},
+		{"no allowlist", "fieldIndexes: []\n", map[schema.GroupVersionKind]bool{secret: false, deployment: false}},
+		{"kinds", "cacheAllowlist:\n- group: apps\n  kind: Deployment\n", map[schema.GroupVersionKind]bool{secret: false, deployment: true}},
+		{"versions", "cacheAllowlist:\n- group: apps\n  version: v1beta1\n  kind: Deployment\n", map[schema.GroupVersionKind]bool{secret: false, deployment: false}},
+		{"any kind of a group", "cacheAllowlist:\n- group: apps\n  kind: \"*\"\n", map[schema.GroupVersionKind]bool{secret: false, deployment: true}},
+		{"any kind", "cacheAllowlist:\n- group: \"*\"\n  kind: \"*\"\n", map[schema.GroupVersionKind]bool{secret: true, deployment: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := load(t, tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for gvk, allowed := range tc.allowed {
+				if cfg.cacheAllowed(gvk) != allowed {
+					t.Errorf("expected caching %s to be allowed %v", gvk, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestFieldIndexesMustBeCached(t *testing.T) {
+	_, err := load(t, "fieldIndexes:\n- group: \"\"\n  version: v1\n  kind: Pod\n  fields: [spec.nodeName]\n")
+	if err == nil {
+		t.Error("expected a field index of a kind that may not be cached to be rejected")
+	}
+	cfg, err := load(t, "fieldIndexes:\n- group: \"\"\n  version: v1\n  kind: Pod\n  fields: [spec.nodeName]\ncacheAllowlist:\n- group: \"\"\n  kind: Pod\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	if fields := cfg.FieldIndexesByKind()[pod]; len(fields) != 1 || fields[0] != "spec.nodeName" {
+		t.Errorf("unexpected field indexes %v", fields)
+	}
+}
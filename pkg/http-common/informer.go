@@ -0,0 +1,23 @@
+package http_common
+
+import (
+	"time"
+)
+
+type InformerInfo struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+	// Watchers is the number of open watches on the informer, it is never stopped while they are open.
+	Watchers int `json:"watchers"`
+	// Pinned informers back field indexes and are never stopped.
+	Pinned  bool `json:"pinned"`
+	Objects int  `json:"objects"`
+	// EstimatedBytes is a rough estimate of the memory the objects of the informer take.
+	EstimatedBytes int64     `json:"estimatedBytes"`
+	LastAccess     time.Time `json:"lastAccess"`
+}
+
+type InformerListResponse struct {
+	Items []InformerInfo `json:"items"`
+}
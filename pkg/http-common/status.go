@@ -0,0 +1,48 @@
+package http_common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrorStatus converts err into the metav1.Status the apiserver would return.
+// Errors that do not carry an API status are reported as internal errors.
+func ErrorStatus(err error) *metav1.Status {
+	var apiStatus apierrors.APIStatus
+	if !errors.As(err, &apiStatus) {
+		apiStatus = apierrors.NewInternalError(err)
+	}
+	status := apiStatus.Status()
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	if status.Status == "" {
+		status.Status = metav1.StatusFailure
+	}
+	if status.Code == 0 {
+		status.Code = http.StatusInternalServerError
+	}
+	return &status
+}
+
+func Error(c *gin.Context, err error) {
+	status := ErrorStatus(err)
+	c.JSON(int(status.Code), status)
+}
+
+func AbortWithError(c *gin.Context, err error) {
+	Error(c, err)
+	c.Abort()
+}
+
+// WriteError is Error for handlers that only have a http.ResponseWriter.
+func WriteError(w http.ResponseWriter, err error) {
+	status := ErrorStatus(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,20 @@
+package http_common
+
+import (
+	"net/http"
+	"strings"
+)
+
+// WantsWatchEvents reports whether a watch request asked for the Kubernetes watch protocol,
+// newline delimited metav1.WatchEvent frames as sent to client-go and kubectl, rather than server-sent events.
+func WantsWatchEvents(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/event-stream")
+}
+
+// IsWatch reports whether a request asks for a watch. Like the query parameter conversion of the apiserver,
+// any value of watch but false and 0 does; handlers and authorization must agree on it.
+func IsWatch(r *http.Request) bool {
+	watch := r.URL.Query()["watch"]
+	return len(watch) > 0 && watch[0] != "0" && !strings.EqualFold(watch[0], "false")
+}
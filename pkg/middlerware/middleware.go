@@ -3,188 +3,95 @@ package middlerware
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/whzghb/kube-apiserver-proxy/pkg/auth"
-	authv1 "k8s.io/api/authentication/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authenticator"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authorizer"
+	http_common "github.com/whzghb/kube-apiserver-proxy/pkg/http-common"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/user"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/types"
 	"net/http"
-	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-	"strings"
-	"time"
+	"slices"
 )
 
-var methodVerbMap = map[string]string{
-	"GET":    "get",
-	"LIST":   "list",
-	"POST":   "create",
-	"PUT":    "update",
-	"PATCH":  "patch",
-	"DELETE": "delete",
-	"Watch":  "watch",
-}
-
-func Auth(mgr ctrl.Manager) gin.HandlerFunc {
+func Auth(authn authenticator.Authenticator, users user.UserStore, authz authorizer.Authorizer) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.URL.String() == "/user/login" {
+		// exemptions go by the matched route, unmatched paths may be proxied to the apiserver
+		switch c.FullPath() {
+		case "/user/login", "/user/oidc/login", "/user/oidc/callback":
 			c.Next()
 			return
 		}
 
 		// 认证
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			c.JSON(http.StatusForbidden, gin.H{"msg": "403 forbidden"})
-			c.Abort()
-			return
-		}
-
-		var name, namespace string
-		var valid bool
-		authToken := strings.TrimPrefix(token, "Bearer ")
-
-		if cache, ok := auth.Cache.Load(authToken[:32]); ok {
-			user := cache.(*auth.UserInfo)
-			name, namespace = user.Name, user.Namespace
-			if user.RenewTime.Add(5 * time.Second).After(time.Now()) {
-				valid = true
+		// tokens are only cached for requests authenticated by them, not by a client certificate
+		token := authenticator.BearerToken(c.Request)
+		cacheable := token != "" && (c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0)
+
+		var userInfo *auth.UserInfo
+		if cacheable {
+			if info, ok := auth.Cache.Get(c.Request.Context(), token); ok {
+				userInfo = info
 			}
 		}
 
-		if !valid {
-			userName, code, err := authenticate(mgr, authToken)
+		if userInfo == nil {
+			info, ok, err := authn.AuthenticateRequest(c.Request)
+			if err != nil {
+				fmt.Printf("authenticate error: %s\n", err)
+			}
+			if !ok {
+				// authentication failures are 401, errors of the apiserver are reported as is,
+				// others, such as keys that could not be fetched, as internal errors
+				var apiStatus apierrors.APIStatus
+				if err == nil || errors.As(err, &apiStatus) && apiStatus.Status().Code == http.StatusUnauthorized {
+					http_common.AbortWithError(c, apierrors.NewUnauthorized("Unauthorized"))
+				} else {
+					http_common.AbortWithError(c, err)
+				}
+				return
+			}
+			userInfo, err = newUserInfo(c.Request.Context(), users, info)
 			if err != nil {
-				c.JSON(code, gin.H{"msg": err.Error()})
-				c.Abort()
+				http_common.AbortWithError(c, err)
 				return
 			}
-			user := strings.Split(userName, ":")
-			name, namespace = user[3], user[2]
-			auth.Cache.Store(authToken[:32], &auth.UserInfo{Namespace: namespace, Name: name, RenewTime: time.Now()})
+			if cacheable {
+				if err = auth.Cache.Set(c.Request.Context(), token, userInfo); err != nil {
+					fmt.Printf("cache token error: %s\n", err)
+				}
+			}
 		}
+		c.Set(auth.ContextKey, userInfo)
 
-		if strings.HasPrefix(c.Request.URL.String(), "/user/logout") {
+		if c.FullPath() == "/user/logout/:name" {
 			c.Next()
 			return
 		}
 
 		// 鉴权
-		roleBindingList := &rbacv1.RoleBindingList{}
-		clusterRoleBindingList := &rbacv1.ClusterRoleBindingList{}
-
-		fieldSelector := fields.OneTermEqualSelector(".subjects[*].name", name)
-		err := mgr.GetClient().List(c.Request.Context(), roleBindingList, &client.ListOptions{
-			FieldSelector: fieldSelector,
-			Namespace:     namespace,
-		})
+		attrs := authorizer.NewAttributes(c.Request)
+		attrs.User = userInfo
+		allowed, err := authz.Authorize(c.Request.Context(), attrs)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
-			c.Abort()
+			http_common.AbortWithError(c, apierrors.NewInternalError(err))
 			return
 		}
-
-		err = mgr.GetClient().List(c.Request.Context(), clusterRoleBindingList, &client.ListOptions{
-			FieldSelector: fieldSelector,
-		})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
-			c.Abort()
+		if !allowed {
+			http_common.AbortWithError(c, authorizer.Forbidden(attrs))
 			return
 		}
-
-		// system:serviceaccount:default:admin
-		rules := make([]rbacv1.PolicyRule, 0, 10)
-		for _, roleBinding := range roleBindingList.Items {
-			role := &rbacv1.Role{}
-			clusterRole := &rbacv1.ClusterRole{}
-			if roleBinding.Kind == "ClusterRole" {
-				err = mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Namespace: roleBinding.Namespace, Name: roleBinding.RoleRef.Name}, clusterRole)
-			} else {
-				err = mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Namespace: roleBinding.Namespace, Name: roleBinding.RoleRef.Name}, role)
-			}
-			if err != nil {
-				if apierrors.IsNotFound(err) {
-					continue
-				}
-				c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
-				c.Abort()
-				return
-			}
-			if len(role.Rules) != 0 {
-				rules = append(rules, role.Rules...)
-				continue
-			}
-			rules = append(rules, clusterRole.Rules...)
-		}
-
-		for _, clusterRoleBinding := range clusterRoleBindingList.Items {
-			clusterRole := &rbacv1.ClusterRole{}
-			err = mgr.GetClient().Get(c.Request.Context(), types.NamespacedName{Name: clusterRoleBinding.RoleRef.Name}, clusterRole)
-			if err != nil {
-				if apierrors.IsNotFound(err) {
-					continue
-				}
-				c.JSON(http.StatusInternalServerError, gin.H{"msg": "server error"})
-				c.Abort()
-				return
-			}
-			rules = append(rules, clusterRole.Rules...)
-		}
-
-		gvr := parseGVR(c)
-		resourceName := parseName(c)
-		method := c.Request.Method
-		for _, rule := range rules {
-			groupMatch, verbMatch := false, false
-			for _, group := range rule.APIGroups {
-				if group != gvr.Group && group != "*" {
-					continue
-				}
-				groupMatch = true
-				break
-			}
-			if !groupMatch {
-				continue
-			}
-
-			for _, verb := range rule.Verbs {
-				if resourceName == "" && c.Request.Method == "GET" {
-					method = "LIST"
-				}
-				if watch := c.Query("watch"); watch == "true" {
-					method = "Watch"
-				}
-				if verb != methodVerbMap[method] && verb != "*" {
-					continue
-				}
-				verbMatch = true
-				break
-			}
-			if !verbMatch {
-				continue
-			}
-
-			for _, resource := range rule.Resources {
-				if resource != gvr.Resource && resource+"s" != gvr.Resource && resource != gvr.Resource+"s" && resource != "*" {
-					continue
-				}
-				c.Next()
-				return
-			}
-		}
-		c.JSON(http.StatusForbidden, gin.H{"msg": "403 forbidden"})
-		c.Abort()
+		c.Set(authorizer.ContextKey, attrs)
+		c.Next()
 	}
 }
 
 func HeadersMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		watch := c.Query("watch")
-		if watch == "" {
+		// requests without a route are proxied as is, the apiserver sets their headers;
+		// the Kubernetes watch protocol is plain JSON, only server-sent events need these headers
+		if !http_common.IsWatch(c.Request) || c.FullPath() == "" || http_common.WantsWatchEvents(c.Request) {
 			c.Next()
 			return
 		}
@@ -196,42 +103,28 @@ func HeadersMiddleware() gin.HandlerFunc {
 	}
 }
 
-type GVR struct {
-	Group    string
-	Version  string
-	Resource string
-}
-
-func parseGVR(c *gin.Context) GVR {
-	return GVR{
-		Group:    c.Param("group"),
-		Version:  c.Param("version"),
-		Resource: c.Param("resource"),
-	}
-}
-
-func parseName(c *gin.Context) string {
-	return c.Param("name")
-}
-
-func authenticate(mgr ctrl.Manager, authToken string) (string, int, error) {
-	tr := &authv1.TokenReview{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "tokenreview",
-		},
-		Spec: authv1.TokenReviewSpec{
-			Token: authToken,
-		},
+// newUserInfo completes the identity of a request. ServiceAccounts of proxy users get the namespaces and groups
+// of the user; other users, e.g. of client certificates or static tokens, have no home namespace.
+func newUserInfo(ctx context.Context, users user.UserStore, info *authenticator.Info) (*auth.UserInfo, error) {
+	userInfo := &auth.UserInfo{
+		Username: info.Name,
+		UID:      info.UID,
+		Groups:   info.Groups,
+		Extra:    info.Extra,
+		Name:     info.Name,
 	}
-
-	err := mgr.GetClient().Create(context.Background(), tr)
-	if err != nil {
-		return "", http.StatusInternalServerError, errors.New("server error")
+	namespace, name, ok := auth.ParseServiceAccountUsername(info.Name)
+	if !ok {
+		return userInfo, nil
 	}
-
-	if !tr.Status.Authenticated {
-		return "", http.StatusForbidden, errors.New("403 forbidden")
+	userInfo.Namespace, userInfo.Name, userInfo.Namespaces = namespace, name, []string{namespace}
+
+	u, err := users.Get(ctx, name)
+	if err == nil && u.HomeNamespace() == namespace {
+		userInfo.Namespaces = u.AllNamespaces()
+		userInfo.Groups = append(slices.Clip(userInfo.Groups), u.Groups...)
+	} else if err != nil && !errors.Is(err, user.ErrNotFound) {
+		return nil, err
 	}
-
-	return tr.Status.User.Username, 0, nil
+	return userInfo, nil
 }
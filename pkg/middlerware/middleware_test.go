@@ -0,0 +1,52 @@
+package middlerware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whzghb/kube-apiserver-proxy/pkg/authenticator"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// failingAuthenticator authenticates no request, returning err.
+type failingAuthenticator struct {
+	err error
+}
+
+func (f failingAuthenticator) AuthenticateRequest(*http.Request) (*authenticator.Info, bool, error) {
+	return nil, false, f.err
+}
+
+func TestAuthErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"rejected credentials", apierrors.NewUnauthorized("verify client certificate: unknown authority"), http.StatusUnauthorized},
+		{"apiserver error", apierrors.NewServiceUnavailable("tokenreview unavailable"), http.StatusServiceUnavailable},
+		{"forbidden tokenreview", apierrors.NewForbidden(schema.GroupResource{Group: "authentication.k8s.io", Resource: "tokenreviews"}, "", errors.New("denied")), http.StatusForbidden},
+		{"internal error", fmt.Errorf("%w: get jwks: connection refused", authenticator.ErrKeysUnavailable), http.StatusInternalServerError},
+		{"joined errors", errors.Join(errors.New("connection refused"), apierrors.NewUnauthorized("bad certificate")), http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(Auth(failingAuthenticator{err: tc.err}, nil, nil))
+			r.GET("/api/v1/pods", func(c *gin.Context) {
+				t.Error("the request was not authenticated but served")
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+			if w.Code != tc.code {
+				t.Errorf("expected %d, got %d %s", tc.code, w.Code, w.Body)
+			}
+		})
+	}
+}
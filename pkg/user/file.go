@@ -0,0 +1,236 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+type userFile struct {
+	Users []*User `json:"users"`
+}
+
+// FileStore keeps users in a YAML or JSON file. The file is reloaded whenever it changes on disk.
+type FileStore struct {
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	size    int64
+	users   map[string]*User
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, users: map[string]*User{}}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, name string) (*User, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user := *u
+	return &user, nil
+}
+
+func (s *FileStore) Verify(ctx context.Context, name, password string) (*User, error) {
+	u, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return verify(u, password)
+}
+
+func (s *FileStore) List(ctx context.Context) ([]*User, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		user := *u
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (s *FileStore) Create(ctx context.Context, u *User, password string) (*User, error) {
+	u, err := newUser(u, password)
+	if err != nil {
+		return nil, err
+	}
+	name := u.Name
+	if err = s.reload(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return nil, ErrAlreadyExists
+	}
+	s.users[name] = u
+	if err = s.save(); err != nil {
+		delete(s.users, name)
+		return nil, err
+	}
+	user := *u
+	return &user, nil
+}
+
+func (s *FileStore) Upsert(ctx context.Context, u *User) (*User, error) {
+	if err := validateName(u.Name); err != nil {
+		return nil, err
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[u.Name]
+	if err := checkUpsert(old, u); err != nil {
+		return nil, err
+	}
+	user := *u
+	user.PasswordHash, user.Disabled = "", false
+	if ok {
+		user.Disabled = old.Disabled
+	}
+	s.users[u.Name] = &user
+	if err := s.save(); err != nil {
+		if ok {
+			s.users[u.Name] = old
+		} else {
+			delete(s.users, u.Name)
+		}
+		return nil, err
+	}
+	result := user
+	return &result, nil
+}
+
+func (s *FileStore) Disable(ctx context.Context, name string) error {
+	if err := s.reload(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.Disabled {
+		return nil
+	}
+	u.Disabled = true
+	if err := s.save(); err != nil {
+		u.Disabled = false
+		return err
+	}
+	return nil
+}
+
+// reload re-reads the file if its modification time or size changed since the last read.
+// A missing file is treated as an empty store. The users of a file that was removed or can no longer be read
+// are dropped, they must not stay active from memory.
+func (s *FileStore) reload() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		s.mu.Lock()
+		if !s.modTime.IsZero() {
+			fmt.Printf("users file %s is gone, its %d users can no longer log in: %s\n", s.path, len(s.users), err)
+		}
+		s.users, s.modTime, s.size = map[string]*User{}, time.Time{}, 0
+		s.mu.Unlock()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime) && info.Size() == s.size
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	f := &userFile{}
+	if err = yaml.Unmarshal(data, f); err != nil {
+		return err
+	}
+	users := make(map[string]*User, len(f.Users))
+	for _, u := range f.Users {
+		if err = validateName(u.Name); err != nil {
+			return err
+		}
+		users[u.Name] = u
+	}
+
+	s.mu.Lock()
+	s.users, s.modTime, s.size = users, info.ModTime(), info.Size()
+	s.mu.Unlock()
+	return nil
+}
+
+// save writes the users back to the file, caller must hold the write lock.
+func (s *FileStore) save() error {
+	f := &userFile{Users: make([]*User, 0, len(s.users))}
+	for _, u := range s.users {
+		f.Users = append(f.Users, u)
+	}
+	sort.Slice(f.Users, func(i, j int) bool { return f.Users[i].Name < f.Users[j].Name })
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+	return nil
+}
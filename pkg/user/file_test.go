@@ -0,0 +1,192 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeUsers replaces the users file as an admin would, with a modification time that differs from the last write.
+func writeUsers(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreParse(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers(t, path, `
+users:
+- name: alice
+  passwordHash: `+hash+`
+  namespace: team-a
+  namespaces: [team-b, team-a]
+  groups: [admins]
+- name: bob
+  passwordHash: `+hash+`
+  disabled: true
+`)
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	alice, err := s.Verify(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.HomeNamespace() != "team-a" || len(alice.AllNamespaces()) != 2 || len(alice.Groups) != 1 || alice.Groups[0] != "admins" {
+		t.Errorf("unexpected user %+v", alice)
+	}
+	if _, err = s.Verify(ctx, "alice", "wrong"); err != ErrInvalidPassword {
+		t.Errorf("expected an invalid password, got %v", err)
+	}
+	if _, err = s.Verify(ctx, "bob", "secret"); err != ErrDisabled {
+		t.Errorf("expected bob to be disabled, got %v", err)
+	}
+	if _, err = s.Get(ctx, "carol"); err != ErrNotFound {
+		t.Errorf("expected carol not to be found, got %v", err)
+	}
+	users, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+		t.Errorf("unexpected users %v", users)
+	}
+
+	for _, data := range []string{"users: [{name: Not_A_Name}]", "users: {"} {
+		writeUsers(t, path, data)
+		if _, err = NewFileStore(path); err == nil {
+			t.Errorf("expected %q to be refused", data)
+		}
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if users, err := s.List(ctx); err != nil || len(users) != 0 {
+		t.Fatalf("expected a missing file to hold no users, got %v %v", users, err)
+	}
+
+	writeUsers(t, path, "users: [{name: alice}]")
+	if _, err = s.Get(ctx, "alice"); err != nil {
+		t.Fatalf("expected alice to be read from the new file, got %v", err)
+	}
+	writeUsers(t, path, "users: [{name: alice}, {name: bob}]")
+	if _, err = s.Get(ctx, "bob"); err != nil {
+		t.Fatalf("expected bob to be read from the edited file, got %v", err)
+	}
+
+	// a file that can no longer be parsed fails the lookups instead of serving the users it had
+	writeUsers(t, path, "users: {")
+	if _, err = s.Get(ctx, "alice"); err == nil || err == ErrNotFound {
+		t.Errorf("expected the broken file to fail, got %v", err)
+	}
+
+	writeUsers(t, path, "users: [{name: alice}]")
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(ctx, "alice"); err != ErrNotFound {
+		t.Errorf("expected the users of the removed file to be gone, got %v", err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root reads files without permission")
+	}
+	writeUsers(t, path, "users: [{name: alice}]")
+	if _, err = s.Get(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(ctx, "alice"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected the unreadable file to fail, got %v", err)
+	}
+	if err = os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err = s.Create(ctx, &User{Name: "alice", Namespace: "team-a"}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Create(ctx, &User{Name: "alice"}, "other"); err != ErrAlreadyExists {
+		t.Errorf("expected alice to exist already, got %v", err)
+	}
+	if _, err = s.Create(ctx, &User{Name: "Not_A_Name"}, "secret"); err == nil {
+		t.Error("expected an invalid name to be refused")
+	}
+	oidc := &User{Name: "bob", Issuer: "https://issuer", Subject: "1234", Groups: []string{"dev"}}
+	if _, err = s.Upsert(ctx, oidc); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Disable(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Disable(ctx, "carol"); err != ErrNotFound {
+		t.Errorf("expected carol not to be found, got %v", err)
+	}
+
+	// another proxy reads what was written
+	other, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := other.Verify(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.HomeNamespace() != "team-a" {
+		t.Errorf("unexpected user %+v", alice)
+	}
+
+	// upserting the same identity keeps the user disabled, other identities and password users are never replaced
+	oidc.Groups = []string{"ops"}
+	bob, err := other.Upsert(ctx, oidc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bob.Disabled || len(bob.Groups) != 1 || bob.Groups[0] != "ops" {
+		t.Errorf("unexpected user %+v", bob)
+	}
+	for _, u := range []*User{
+		{Name: "bob", Issuer: "https://issuer", Subject: "5678"},
+		{Name: "alice", Issuer: "https://issuer", Subject: "1234"},
+	} {
+		if _, err = other.Upsert(ctx, u); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("expected %s of %s not to be replaced, got %v", u.Name, u.Subject, err)
+		}
+	}
+	if _, err = other.Upsert(ctx, &User{Name: "carol"}); err == nil {
+		t.Error("expected a user without identity to be refused")
+	}
+}
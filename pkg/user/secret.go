@@ -0,0 +1,203 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SecretStore keeps users in a single Secret, one data key per user holding the JSON encoded User.
+// Reads go through reader (usually the manager's API reader) so that the proxy does not cache every Secret.
+type SecretStore struct {
+	client client.Client
+	reader client.Reader
+	key    types.NamespacedName
+}
+
+func NewSecretStore(c client.Client, reader client.Reader, namespace, name string) *SecretStore {
+	return &SecretStore{client: c, reader: reader, key: types.NamespacedName{Namespace: namespace, Name: name}}
+}
+
+func (s *SecretStore) Get(ctx context.Context, name string) (*User, error) {
+	secret, err := s.getSecret(ctx)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	data, ok := secret.Data[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return decodeUser(name, data)
+}
+
+func (s *SecretStore) Verify(ctx context.Context, name, password string) (*User, error) {
+	u, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return verify(u, password)
+}
+
+func (s *SecretStore) List(ctx context.Context) ([]*User, error) {
+	secret, err := s.getSecret(ctx)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return []*User{}, nil
+		}
+		return nil, err
+	}
+	users := make([]*User, 0, len(secret.Data))
+	for name, data := range secret.Data {
+		u, err := decodeUser(name, data)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (s *SecretStore) Create(ctx context.Context, u *User, password string) (*User, error) {
+	u, err := newUser(u, password)
+	if err != nil {
+		return nil, err
+	}
+	name := u.Name
+	data, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.getSecret(ctx)
+		if apierrors.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.key.Namespace, Name: s.key.Name},
+				Data:       map[string][]byte{name: data},
+			}
+			return s.client.Create(ctx, secret)
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := secret.Data[name]; ok {
+			return ErrAlreadyExists
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[name] = data
+		return s.client.Update(ctx, secret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *SecretStore) Upsert(ctx context.Context, u *User) (*User, error) {
+	if err := validateName(u.Name); err != nil {
+		return nil, err
+	}
+	if err := checkUpsert(nil, u); err != nil {
+		return nil, err
+	}
+	user := *u
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		user.PasswordHash, user.Disabled = "", false
+		secret, err := s.getSecret(ctx)
+		if apierrors.IsNotFound(err) {
+			data, err := json.Marshal(&user)
+			if err != nil {
+				return err
+			}
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.key.Namespace, Name: s.key.Name},
+				Data:       map[string][]byte{user.Name: data},
+			}
+			return s.client.Create(ctx, secret)
+		}
+		if err != nil {
+			return err
+		}
+		if data, ok := secret.Data[user.Name]; ok {
+			old, err := decodeUser(user.Name, data)
+			if err != nil {
+				return err
+			}
+			if err = checkUpsert(old, &user); err != nil {
+				return err
+			}
+			user.Disabled = old.Disabled
+		}
+		data, err := json.Marshal(&user)
+		if err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[user.Name] = data
+		return s.client.Update(ctx, secret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *SecretStore) Disable(ctx context.Context, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.getSecret(ctx)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return ErrNotFound
+			}
+			return err
+		}
+		data, ok := secret.Data[name]
+		if !ok {
+			return ErrNotFound
+		}
+		u, err := decodeUser(name, data)
+		if err != nil {
+			return err
+		}
+		if u.Disabled {
+			return nil
+		}
+		u.Disabled = true
+		if secret.Data[name], err = json.Marshal(u); err != nil {
+			return err
+		}
+		return s.client.Update(ctx, secret)
+	})
+}
+
+func (s *SecretStore) getSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := s.reader.Get(ctx, s.key, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func decodeUser(name string, data []byte) (*User, error) {
+	u := &User{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, err
+	}
+	u.Name = name
+	return u, nil
+}
@@ -0,0 +1,128 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestSecretStore(objects ...client.Object) (*SecretStore, client.Client) {
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objects...).Build()
+	return NewSecretStore(c, c, "proxy", "users"), c
+}
+
+func TestSecretStoreRead(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestSecretStore(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "proxy", Name: "users"},
+		Data: map[string][]byte{
+			"alice": []byte(`{"passwordHash":"` + hash + `","namespace":"team-a","groups":["admins"]}`),
+			"bob":   []byte(`{"passwordHash":"` + hash + `","disabled":true}`),
+		},
+	})
+	ctx := context.Background()
+
+	// the name comes from the data key
+	alice, err := s.Verify(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Name != "alice" || alice.HomeNamespace() != "team-a" || len(alice.Groups) != 1 {
+		t.Errorf("unexpected user %+v", alice)
+	}
+	if _, err = s.Verify(ctx, "alice", "wrong"); err != ErrInvalidPassword {
+		t.Errorf("expected an invalid password, got %v", err)
+	}
+	if _, err = s.Verify(ctx, "bob", "secret"); err != ErrDisabled {
+		t.Errorf("expected bob to be disabled, got %v", err)
+	}
+	if _, err = s.Get(ctx, "carol"); err != ErrNotFound {
+		t.Errorf("expected carol not to be found, got %v", err)
+	}
+	users, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+		t.Errorf("unexpected users %v", users)
+	}
+
+	// without the Secret there are no users
+	empty, _ := newTestSecretStore()
+	if _, err = empty.Get(ctx, "alice"); err != ErrNotFound {
+		t.Errorf("expected alice not to be found, got %v", err)
+	}
+	if users, err = empty.List(ctx); err != nil || len(users) != 0 {
+		t.Errorf("expected no users, got %v %v", users, err)
+	}
+}
+
+func TestSecretStoreWrite(t *testing.T) {
+	s, c := newTestSecretStore()
+	ctx := context.Background()
+
+	// the first user creates the Secret, the next ones update it
+	if _, err := s.Create(ctx, &User{Name: "alice"}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, &User{Name: "bob"}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, &User{Name: "alice"}, "other"); err != ErrAlreadyExists {
+		t.Errorf("expected alice to exist already, got %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "proxy", Name: "users"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) != 2 {
+		t.Errorf("unexpected Secret data %v", secret.Data)
+	}
+	if _, err := s.Verify(ctx, "alice", "secret"); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Disable(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Verify(ctx, "bob", "secret"); err != ErrDisabled {
+		t.Errorf("expected bob to be disabled, got %v", err)
+	}
+	if err := s.Disable(ctx, "carol"); err != ErrNotFound {
+		t.Errorf("expected carol not to be found, got %v", err)
+	}
+
+	// upserting the same identity keeps the user disabled, other identities and password users are never replaced
+	oidc := &User{Name: "carol", Issuer: "https://issuer", Subject: "1234"}
+	if _, err := s.Upsert(ctx, oidc); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Disable(ctx, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	oidc.Groups = []string{"ops"}
+	carol, err := s.Upsert(ctx, oidc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !carol.Disabled || len(carol.Groups) != 1 {
+		t.Errorf("unexpected user %+v", carol)
+	}
+	for _, u := range []*User{
+		{Name: "carol", Issuer: "https://issuer", Subject: "5678"},
+		{Name: "alice", Issuer: "https://issuer", Subject: "1234"},
+	} {
+		if _, err = s.Upsert(ctx, u); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("expected %s of %s not to be replaced, got %v", u.Name, u.Subject, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const DefaultNamespace = "default"
+
+var (
+	ErrNotFound        = errors.New("user not found")
+	ErrAlreadyExists   = errors.New("user already exists")
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrDisabled        = errors.New("user disabled")
+)
+
+// User is a proxy identity. Each user logs in as its own ServiceAccount named after Name,
+// created in the user's home namespace.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordHash"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	// Namespace is the home namespace holding the user's ServiceAccount, defaults to DefaultNamespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Namespaces are additional namespaces whose RoleBindings apply to the user.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Groups are added to the groups of the user's ServiceAccount when authorizing, e.g. the groups of an OIDC provider.
+	Groups []string `json:"groups,omitempty"`
+	// Issuer and Subject identify the account of users logging in through an OpenID provider, who have no password.
+	Issuer  string `json:"issuer,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+func (u *User) HomeNamespace() string {
+	if u.Namespace == "" {
+		return DefaultNamespace
+	}
+	return u.Namespace
+}
+
+// AllNamespaces returns the home namespace followed by the additional namespaces, without duplicates.
+func (u *User) AllNamespaces() []string {
+	namespaces := []string{u.HomeNamespace()}
+	for _, ns := range u.Namespaces {
+		if !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// UserStore looks up and manages the users allowed to log in to the proxy.
+type UserStore interface {
+	Get(ctx context.Context, name string) (*User, error)
+	Verify(ctx context.Context, name, password string) (*User, error)
+	List(ctx context.Context) ([]*User, error)
+	Create(ctx context.Context, u *User, password string) (*User, error)
+	// Upsert creates u or replaces the stored user of the same Issuer and Subject, keeping its disabled flag.
+	// Users created this way have no password and are authenticated by an OIDC provider. Password users
+	// and users of another identity are never replaced, ErrAlreadyExists is returned instead.
+	Upsert(ctx context.Context, u *User) (*User, error)
+	Disable(ctx context.Context, name string) error
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func newUser(u *User, password string) (*User, error) {
+	if err := validateName(u.Name); err != nil {
+		return nil, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := *u
+	user.PasswordHash = hash
+	return &user, nil
+}
+
+// checkUpsert makes sure u is a user of a provider identity and old, if stored, the user of the same one.
+func checkUpsert(old, u *User) error {
+	if u.Issuer == "" || u.Subject == "" {
+		return fmt.Errorf("user %q has no issuer and subject", u.Name)
+	}
+	if old != nil && (old.PasswordHash != "" || old.Issuer != u.Issuer || old.Subject != u.Subject) {
+		return fmt.Errorf("%w: %q is not the user of %s at %s", ErrAlreadyExists, u.Name, u.Subject, u.Issuer)
+	}
+	return nil
+}
+
+func verify(u *User, password string) (*User, error) {
+	if u.Disabled {
+		return nil, ErrDisabled
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidPassword
+	}
+	return u, nil
+}
+
+// validateName makes sure the user name can be used as a ServiceAccount name.
+func validateName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+		return fmt.Errorf("invalid user name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}